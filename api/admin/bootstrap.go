@@ -0,0 +1,70 @@
+package admin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/hlandau/passlib.v1"
+)
+
+// Give a user the administrator role, returning whether they exist
+func Promote(db *gorm.DB, username string) bool {
+	return db.Model(&database.User{}).Where("username = ?", username).Update("role", database.RoleAdmin).RowsAffected > 0
+}
+
+// Create the first administrator from the configuration if there are none
+func Bootstrap(db *gorm.DB) {
+	logger := logrus.WithField("app", "admin")
+
+	username := viper.GetString("admin.username")
+	if username == "" {
+		return
+	}
+
+	// Only bootstrap when no administrator exists
+	var count int
+	db.Model(&database.User{}).Where("role = ?", database.RoleAdmin).Count(&count)
+	if count != 0 {
+		logger.Trace("Administrator already exists, skipping bootstrap")
+		return
+	}
+
+	// Promote an existing user
+	if Promote(db, username) {
+		logger.WithField("username", username).Info("Promoted configured user to administrator")
+		return
+	}
+
+	// Directory users are created when they first login, and local users cannot login with only the directory
+	if viper.GetString("auth.backend") == "ldap" {
+		logger.WithField("username", username).Warn("Configured administrator does not exist, it will be promoted once it logs in through the directory and the server restarts")
+		return
+	}
+
+	// Create the user, hashing the password the same way clients do
+	if viper.GetString("admin.email") == "" || viper.GetString("admin.password") == "" {
+		logger.WithField("username", username).Warn("Configured administrator does not exist and no email or password was given to create it")
+		return
+	}
+	digest := sha256.Sum256([]byte(viper.GetString("admin.password")))
+	hash, err := passlib.Hash(hex.EncodeToString(digest[:]))
+	if err != nil {
+		logger.WithError(err).Error("Failed to hash administrator password")
+		return
+	}
+
+	user := database.User{
+		Name:     username,
+		Email:    viper.GetString("admin.email"),
+		Username: username,
+		Password: hash,
+		Verified: true,
+		Role:     database.RoleAdmin,
+	}
+	db.NewRecord(user)
+	db.Create(&user)
+	logger.WithField("username", username).Info("Created configured administrator")
+}
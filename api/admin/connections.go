@@ -0,0 +1,20 @@
+package admin
+
+import (
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+func listConnections(w http.ResponseWriter, r *http.Request, hub *websockets.Hub) {
+	logger := logrus.WithFields(logrus.Fields{"app": "admin", "remote_address": r.RemoteAddr, "path": "/api/admin/connections", "method": "GET"})
+
+	// Get live connections, optionally for a single user
+	username := r.URL.Query().Get("username")
+	connections := hub.ConnectionList(username)
+	logger.WithField("username", username).Trace("Retrieved live connections")
+
+	util.Responses.SuccessWithData(w, connections)
+	logger.Debug("Listed websocket connections")
+}
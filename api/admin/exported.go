@@ -0,0 +1,89 @@
+package admin
+
+import (
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
+	"github.com/jinzhu/gorm"
+	"net/http"
+)
+
+// Methods pertaining to all users such as listing
+func AllUsers(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listUsers(w, r, db)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Methods pertaining to a specific user such as changing their role, disabling, and deleting
+func SpecificUser(db *gorm.DB, hub *websockets.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			updateUser(w, r, db, hub)
+
+		case http.MethodDelete:
+			deleteUser(w, r, db, hub)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Force a user to logout of all their sessions
+func Logout(db *gorm.DB, hub *websockets.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			logoutUser(w, r, db, hub)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Remove lockouts from a user's account
+func Unlock(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			unlockUser(w, r, db)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Get statistics about the server
+func Stats(db *gorm.DB, hub *websockets.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			stats(w, r, db, hub)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// List the live websocket connections of each user
+func Connections(hub *websockets.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listConnections(w, r, hub)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
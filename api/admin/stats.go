@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// When the server was started
+var started = time.Now()
+
+func stats(w http.ResponseWriter, r *http.Request, db *gorm.DB, hub *websockets.Hub) {
+	logger := logrus.WithFields(logrus.Fields{"app": "admin", "remote_address": r.RemoteAddr, "path": "/api/admin/stats", "method": "GET"})
+
+	// Count users by status
+	var users, verified, disabled, admins int
+	db.Model(&database.User{}).Count(&users)
+	db.Model(&database.User{}).Where("verified = ?", true).Count(&verified)
+	db.Model(&database.User{}).Where("disabled = ?", true).Count(&disabled)
+	db.Model(&database.User{}).Where("role = ?", database.RoleAdmin).Count(&admins)
+	logger.Trace("Counted users")
+
+	// Count content and sessions
+	var chats, messages, files, sessions int
+	db.Model(&database.Chat{}).Count(&chats)
+	db.Model(&database.Message{}).Count(&messages)
+	db.Model(&database.File{}).Count(&files)
+	db.Model(&database.Session{}).Count(&sessions)
+	logger.Trace("Counted chats, messages, files and sessions")
+
+	// Get live connections
+	connectedUsers, connections := hub.Connections()
+
+	util.Responses.SuccessWithData(w, map[string]interface{}{
+		"users": map[string]int{
+			"total":    users,
+			"verified": verified,
+			"disabled": disabled,
+			"admins":   admins,
+		},
+		"chats":    chats,
+		"messages": messages,
+		"files":    files,
+		"sessions": sessions,
+		"websockets": map[string]int{
+			"users":       connectedUsers,
+			"connections": connections,
+		},
+		"uptime":     int64(time.Since(started).Seconds()),
+		"goroutines": runtime.NumGoroutine(),
+	})
+	logger.Debug("Retrieved server statistics")
+}
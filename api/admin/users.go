@@ -0,0 +1,202 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/akrantz01/apcsp/api/authentication"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+func listUsers(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "admin", "remote_address": r.RemoteAddr, "path": "/api/admin/users", "method": "GET"})
+
+	// Get all users, optionally filtered by username
+	var users []database.User
+	query := db.Order("id asc")
+	if username := r.URL.Query().Get("username"); username != "" {
+		query = query.Where("username LIKE ?", username+"%")
+	}
+	query.Find(&users)
+	logger.WithField("count", len(users)).Trace("Retrieved users from database")
+
+	// Convert to response format
+	response := []map[string]interface{}{}
+	for _, user := range users {
+		response = append(response, map[string]interface{}{
+			"name":       user.Name,
+			"username":   user.Username,
+			"email":      user.Email,
+			"role":       user.Role,
+			"verified":   user.Verified,
+			"disabled":   user.Disabled,
+			"source":     user.Source,
+			"created_at": user.CreatedAt.Unix(),
+		})
+	}
+
+	util.Responses.SuccessWithData(w, response)
+	logger.Debug("Retrieved list of all users")
+}
+
+func updateUser(w http.ResponseWriter, r *http.Request, db *gorm.DB, hub *websockets.Hub) {
+	logger := logrus.WithFields(logrus.Fields{"app": "admin", "remote_address": r.RemoteAddr, "path": "/api/admin/users/{user}", "method": "PUT"})
+
+	// Validate initial request on headers and body
+	if r.Header.Get("Content-Type") != "application/json" {
+		logger.WithField("content_type", r.Header.Get("Content-Type")).Trace("Invalid content type")
+		util.Responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+		return
+	} else if r.Body == nil {
+		logger.Trace("No request body given")
+		util.Responses.Error(w, http.StatusBadRequest, "request body must exist")
+		return
+	}
+	logger.Trace("Validated initial request")
+
+	// Validate JSON body
+	var body struct {
+		Role     string `json:"role"`
+		Disabled *bool  `json:"disabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.WithError(err).Trace("Invalid json body")
+		util.Responses.Error(w, http.StatusBadRequest, "unable to decode JSON: "+err.Error())
+		return
+	} else if body.Role != "" && !database.ValidRole(body.Role) {
+		logger.WithField("role", body.Role).Trace("Invalid role")
+		util.Responses.Error(w, http.StatusBadRequest, "field 'role' must be one of 'user', 'moderator', or 'admin'")
+		return
+	}
+	logger.Trace("Validated JSON body")
+
+	// Get the user being modified
+	user, err := targetUser(r, db)
+	if err != nil {
+		logger.WithError(err).Trace("Unable to get user")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger = logger.WithField("username", user.Username)
+
+	// Modify role if passed
+	if body.Role != "" {
+		user.Role = body.Role
+		logger.WithField("role", body.Role).Trace("Set new role for user")
+	}
+
+	// Disable or enable the user if passed
+	disabling := body.Disabled != nil && *body.Disabled && !user.Disabled
+	if body.Disabled != nil {
+		user.Disabled = *body.Disabled
+		logger.WithField("disabled", *body.Disabled).Trace("Set disabled status for user")
+	}
+
+	db.Save(&user)
+	logger.Trace("Saved new user information to database")
+
+	// Remove all access from a disabled user
+	if disabling {
+		util.JWT.Revoke(db, "user_id = ?", user.ID)
+		db.Delete(database.Session{}, "user_id = ?", user.ID)
+		hub.CloseUser(user.Username, "account disabled")
+		logger.Trace("Revoked all tokens and sessions for disabled user")
+	}
+
+	util.Responses.Success(w)
+	logger.Info("Administrator updated user")
+}
+
+func deleteUser(w http.ResponseWriter, r *http.Request, db *gorm.DB, hub *websockets.Hub) {
+	logger := logrus.WithFields(logrus.Fields{"app": "admin", "remote_address": r.RemoteAddr, "path": "/api/admin/users/{user}", "method": "DELETE"})
+
+	// Get the user being deleted
+	user, err := targetUser(r, db)
+	if err != nil {
+		logger.WithError(err).Trace("Unable to get user")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger = logger.WithField("username", user.Username)
+
+	// Delete the user and all associated tokens
+	util.JWT.Revoke(db, "user_id = ?", user.ID)
+	db.Delete(database.Session{}, "user_id = ?", user.ID)
+	db.Delete(database.RecoveryCode{}, "user_id = ?", user.ID)
+	db.Delete(&user)
+	hub.CloseUser(user.Username, "account deleted")
+	logger.Trace("Revoked all tokens and sessions, and deleted user")
+
+	util.Responses.Success(w)
+	logger.Info("Administrator deleted user")
+}
+
+func logoutUser(w http.ResponseWriter, r *http.Request, db *gorm.DB, hub *websockets.Hub) {
+	logger := logrus.WithFields(logrus.Fields{"app": "admin", "remote_address": r.RemoteAddr, "path": "/api/admin/users/{user}/logout", "method": "POST"})
+
+	// Get the user being logged out
+	user, err := targetUser(r, db)
+	if err != nil {
+		logger.WithError(err).Trace("Unable to get user")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger = logger.WithField("username", user.Username)
+
+	// Revoke all session tokens, leaving personal access tokens
+	util.JWT.Revoke(db, "user_id = ? AND type IN (?)", user.ID, []int{database.TokenAuthentication, database.TokenRefresh, database.TokenMFAPending})
+	db.Delete(database.Session{}, "user_id = ?", user.ID)
+	hub.CloseUser(user.Username, "logged out by administrator")
+	logger.Trace("Revoked all sessions for user")
+
+	util.Responses.Success(w)
+	logger.Info("Administrator logged out user")
+}
+
+func unlockUser(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "admin", "remote_address": r.RemoteAddr, "path": "/api/admin/users/{user}/unlock", "method": "POST"})
+
+	// Ensure user exists
+	var user database.User
+	db.Where("username = ?", mux.Vars(r)["user"]).First(&user)
+	if user.ID == 0 {
+		logger.WithField("user", mux.Vars(r)["user"]).Trace("User does not exist")
+		util.Responses.Error(w, http.StatusBadRequest, "specified user does not exist")
+		return
+	}
+	logger = logger.WithField("username", user.Username)
+
+	// Remove lockouts
+	unlocked := authentication.Unlock(db, user.Username)
+
+	util.Responses.SuccessWithData(w, map[string]bool{"unlocked": unlocked})
+	logger.WithField("unlocked", unlocked).Info("Administrator unlocked user")
+}
+
+// Get the user from the path, preventing administrators from modifying themselves so the last one cannot be removed
+func targetUser(r *http.Request, db *gorm.DB) (database.User, error) {
+	var user database.User
+	db.Where("username = ?", mux.Vars(r)["user"]).First(&user)
+	if user.ID == 0 {
+		return user, errors.New("specified user does not exist")
+	}
+
+	// Get requesting user from token
+	token, err := util.JWT.Unvalidated(r.Header.Get("Authorization"))
+	if err != nil {
+		return user, err
+	}
+	uid, err := util.JWT.UserId(token)
+	if err != nil {
+		return user, err
+	} else if uid == user.ID {
+		return user, errors.New("not allowed to modify your own account")
+	}
+
+	return user, nil
+}
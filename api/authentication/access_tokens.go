@@ -0,0 +1,197 @@
+package authentication
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Methods pertaining to all of a user's personal access tokens such as listing and creation
+func AccessTokens(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listAccessTokens(w, r, db)
+
+		case http.MethodPost:
+			createAccessToken(w, r, db)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Methods pertaining to a specific personal access token such as revocation
+func SpecificAccessToken(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodDelete:
+			revokeAccessToken(w, r, db)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+func listAccessTokens(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/tokens", "method": "GET"})
+
+	// Get the requesting user
+	uid, _, err := currentSession(r, db)
+	if err != nil {
+		logger.WithError(err).Trace("Failed to get user id from token")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger = logger.WithField("uid", uid)
+
+	// Get all personal access tokens for the user
+	var tokens []database.Token
+	db.Where("user_id = ? AND type = ?", uid, database.TokenPersonalAccess).Order("created_at desc").Find(&tokens)
+	logger.WithField("count", len(tokens)).Trace("Retrieved personal access tokens for user")
+
+	// Convert to response format
+	response := []map[string]interface{}{}
+	for _, token := range tokens {
+		var expiresAt interface{}
+		if token.ExpiresAt != nil {
+			expiresAt = token.ExpiresAt.Unix()
+		}
+
+		response = append(response, map[string]interface{}{
+			"id":         token.ID,
+			"name":       token.Name,
+			"scopes":     strings.Fields(token.Scopes),
+			"created_at": token.CreatedAt.Unix(),
+			"expires_at": expiresAt,
+		})
+	}
+
+	util.Responses.SuccessWithData(w, response)
+	logger.Debug("Retrieved list of personal access tokens for user")
+}
+
+func createAccessToken(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/tokens", "method": "POST"})
+
+	// Validate initial request on headers and body
+	if r.Header.Get("Content-Type") != "application/json" {
+		logger.WithField("content_type", r.Header.Get("Content-Type")).Trace("Invalid content type")
+		util.Responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+		return
+	} else if r.Body == nil {
+		logger.Trace("No request body given")
+		util.Responses.Error(w, http.StatusBadRequest, "request body must exist")
+		return
+	}
+	logger.Trace("Validated initial request")
+
+	// Validate JSON body
+	var body struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn int64    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.WithError(err).Trace("Invalid json body")
+		util.Responses.Error(w, http.StatusBadRequest, "unable to decode JSON: "+err.Error())
+		return
+	} else if body.Name == "" || len(body.Scopes) == 0 {
+		logger.WithFields(logrus.Fields{"name": body.Name, "scopes": len(body.Scopes)}).Trace("Field name or scopes not given")
+		util.Responses.Error(w, http.StatusBadRequest, "fields 'name' and 'scopes' are required")
+		return
+	} else if body.ExpiresIn < 0 {
+		logger.WithField("expires_in", body.ExpiresIn).Trace("Invalid expiration")
+		util.Responses.Error(w, http.StatusBadRequest, "field 'expires_in' must be positive")
+		return
+	}
+
+	// Ensure all scopes exist
+	for _, scope := range body.Scopes {
+		valid := false
+		for _, s := range database.TokenScopes {
+			if scope == s {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			logger.WithField("scope", scope).Trace("Invalid scope")
+			util.Responses.Error(w, http.StatusBadRequest, "invalid scope: "+scope)
+			return
+		}
+	}
+	logger.Trace("Validated JSON body")
+
+	// Get the requesting user
+	uid, _, err := currentSession(r, db)
+	if err != nil {
+		logger.WithError(err).Trace("Failed to get user id from token")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger = logger.WithField("uid", uid)
+
+	// Generate the token
+	storedToken := database.Token{
+		Type:   database.TokenPersonalAccess,
+		UserId: uid,
+		Name:   body.Name,
+		Scopes: strings.Join(body.Scopes, " "),
+	}
+	token, err := util.JWT.Create(&storedToken, body.ExpiresIn, db)
+	if err != nil {
+		logger.WithError(err).Error("Unable to generate personal access token")
+		util.Responses.Error(w, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+
+	util.Responses.SuccessWithData(w, map[string]interface{}{"id": storedToken.ID, "token": token})
+	logger.WithField("key_id", storedToken.ID).Debug("Created personal access token")
+}
+
+func revokeAccessToken(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/tokens/{token}", "method": "DELETE"})
+
+	// Validate initial request on path parameters
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["token"], 10, 32)
+	if err != nil {
+		logger.WithField("token", vars["token"]).Trace("Invalid value for path parameter")
+		util.Responses.Error(w, http.StatusBadRequest, "path parameter 'token' must be an integer")
+		return
+	}
+	logger = logger.WithField("token", id)
+
+	// Get the requesting user
+	uid, _, err := currentSession(r, db)
+	if err != nil {
+		logger.WithError(err).Trace("Failed to get user id from token")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger = logger.WithField("uid", uid)
+
+	// Ensure token exists and belongs to the user
+	var storedToken database.Token
+	db.Where("id = ? AND user_id = ? AND type = ?", id, uid, database.TokenPersonalAccess).First(&storedToken)
+	if storedToken.ID == 0 {
+		logger.Trace("Specified token does not exist")
+		util.Responses.Error(w, http.StatusBadRequest, "specified token does not exist")
+		return
+	}
+
+	// Revoke the token
+	util.JWT.Revoke(db, "id = ?", storedToken.ID)
+
+	util.Responses.Success(w)
+	logger.Debug("Revoked personal access token")
+}
@@ -2,12 +2,8 @@ package authentication
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/base64"
-	"fmt"
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gobuffalo/packr/v2"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
@@ -15,7 +11,6 @@ import (
 	"gopkg.in/gomail.v2"
 	"html/template"
 	"net/http"
-	"time"
 )
 
 func ForgotPassword(db *gorm.DB, mail chan *gomail.Message, box *packr.Box) func(w http.ResponseWriter, r *http.Request) {
@@ -44,10 +39,18 @@ func ForgotPassword(db *gorm.DB, mail chan *gomail.Message, box *packr.Box) func
 		}
 		logger.Trace("Validated request")
 
+		// Ensure emails are not being sent too often
+		if wait := throttled(db, emailKey(r.URL.Query().Get("username")), addressKey(remoteIP(r))); wait > 0 {
+			logger.WithFields(logrus.Fields{"username": r.URL.Query().Get("username"), "wait": wait}).Trace("Forgot password request throttled")
+			tooManyAttempts(w, wait)
+			return
+		}
+
 		// Check if user exists
 		var user database.User
 		db.Where("username = ?", r.URL.Query().Get("username")).First(&user)
 		if user.ID == 0 {
+			recordFailure(db, addressKey(remoteIP(r)), addressPolicy())
 			logger.WithField("username", r.URL.Query().Get("username")).Trace("User not found in database")
 			util.Responses.Error(w, http.StatusBadRequest, "specified user does not exist")
 			return
@@ -56,43 +59,27 @@ func ForgotPassword(db *gorm.DB, mail chan *gomail.Message, box *packr.Box) func
 		// Add username to logger
 		logger = logger.WithField("username", user.Username)
 
-		// Create signing key for JWT
-		signingKey := make([]byte, 128)
-		if _, err := rand.Read(signingKey); err != nil {
-			logger.WithError(err).Error("Unable to generate JWT signing key")
-			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate JWT signing key")
+		// Passwords of directory users can only be changed in the directory
+		if user.Source == database.SourceLDAP {
+			logger.Trace("Password is managed by directory")
+			util.Responses.Error(w, http.StatusBadRequest, "password is managed by the directory")
 			return
 		}
-		logger.Trace("Generated new signing key bytes for JWT")
-
-		// Save key to database
-		storedToken := database.Token{
-			SigningKey: base64.StdEncoding.EncodeToString(signingKey),
-			UserId:     user.ID,
-			Type:       database.TokenResetPassword,
-		}
-		db.NewRecord(storedToken)
-		db.Create(&storedToken)
-		logger.Trace("Stored signing key and user id in database")
 
-		// Generate token with claims
-		token := jwt.NewWithClaims(jwt.SigningMethodHS512, &jwt.StandardClaims{
-			ExpiresAt: time.Now().Unix() + tokenExpiration,
-			IssuedAt:  time.Now().Unix(),
-			NotBefore: time.Now().Unix(),
-			Subject:   fmt.Sprint(user.ID),
-		})
-		token.Header["kid"] = storedToken.ID
-		logger.Trace("Generated JWT claims")
+		// Count email towards rate limit
+		recordFailure(db, emailKey(user.Username), emailPolicy())
 
-		// Sign token
-		signed, err := token.SignedString(signingKey)
+		// Generate reset password token
+		signed, err := util.JWT.Create(&database.Token{
+			Type:   database.TokenResetPassword,
+			UserId: user.ID,
+		}, tokenExpiration, db)
 		if err != nil {
-			logger.WithError(err).Error("Unable to sign JWT")
-			util.Responses.Error(w, http.StatusInternalServerError, "failed to sign JWT")
+			logger.WithError(err).Error("Unable to generate reset password token")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate reset password token")
 			return
 		}
-		logger.Trace("Signed JWT with signing key")
+		logger.Trace("Generated reset password token")
 
 		// Render template to string
 		stringBuffer := bytes.NewBuffer([]byte{})
@@ -0,0 +1,41 @@
+package authentication
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Publish the public keys tokens are signed with so other services can verify them
+func JWKS(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/.well-known/jwks.json", "method": "GET"})
+
+		// Validate request on method
+		if r.Method != http.MethodGet {
+			logger.WithField("method", r.Method).Trace("Invalid request method")
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		// Get all public keys
+		keys, err := util.JWT.KeySet(db)
+		if err != nil {
+			logger.WithError(err).Error("Unable to load public keys")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to load public keys")
+			return
+		}
+
+		// Respond in the standard key set format
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys}); err != nil {
+			logger.WithError(err).Error("Unable to write key set")
+			return
+		}
+		logger.Debug("Published public key set")
+	}
+}
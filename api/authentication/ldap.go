@@ -0,0 +1,72 @@
+package authentication
+
+import (
+	"errors"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+)
+
+var (
+	// The email from the directory already belongs to another user
+	errLDAPEmailTaken = errors.New("email is already used by another user")
+
+	// The username belongs to a local user, which the directory cannot take over
+	errLDAPLocalUser = errors.New("user is not managed by the directory")
+)
+
+// Check if a user's credentials should be checked against the directory
+func useLDAP(user database.User) bool {
+	switch viper.GetString("auth.backend") {
+	case "ldap":
+		return true
+	case "both":
+		return user.ID == 0 || user.Source == database.SourceLDAP
+	default:
+		return false
+	}
+}
+
+// Authenticate a user against the directory, creating or syncing their local user from its attributes
+func ldapLogin(db *gorm.DB, user database.User, username, password string) (database.User, error) {
+	// Prevent a directory user with the same username from taking over a local user
+	if user.ID != 0 && user.Source != database.SourceLDAP {
+		return user, errLDAPLocalUser
+	}
+
+	entry, err := util.LDAP.Authenticate(username, password)
+	if err != nil {
+		return user, err
+	}
+
+	// Sync attributes from the directory
+	if entry.Name == "" {
+		entry.Name = username
+	}
+	if entry.Email != "" && entry.Email != user.Email {
+		var count int
+		db.Model(&database.User{}).Where("email = ? AND id <> ?", entry.Email, user.ID).Count(&count)
+		if count != 0 {
+			return user, errLDAPEmailTaken
+		}
+	}
+	user.Username = username
+	user.Name = entry.Name
+	if entry.Email != "" {
+		user.Email = entry.Email
+	}
+	user.Password = ""
+	user.Source = database.SourceLDAP
+	user.Verified = true
+
+	// Provision the user if they have not logged in before
+	if user.ID == 0 {
+		db.NewRecord(user)
+		db.Create(&user)
+	} else {
+		db.Save(&user)
+	}
+
+	return user, nil
+}
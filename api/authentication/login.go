@@ -1,24 +1,28 @@
 package authentication
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
-	"github.com/dgrijalva/jwt-go"
+	"github.com/gobuffalo/packr/v2"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
 	"gopkg.in/hlandau/passlib.v1"
+	"html/template"
 	"net/http"
-	"time"
 )
 
 const tokenExpiration = 60 * 60 * 24 * 3
 
 // Generate authentication tokens for users given a username and password
-func Login(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+func Login(db *gorm.DB, mail chan *gomail.Message, box *packr.Box) func(w http.ResponseWriter, r *http.Request) {
+	// Load email templates
+	accountLocked := accountLockedTemplate(box)
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/login", "method": "POST"})
 
@@ -47,17 +51,26 @@ func Login(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 			logger.WithFields(logrus.Fields{"username": body.Username, "password": len(body.Password)}).Trace("Field username or password not given")
 			util.Responses.Error(w, http.StatusBadRequest, "fields 'username' and 'password' are required")
 			return
-		} else if len(body.Password) != 64 {
+		} else if viper.GetString("auth.backend") == "local" && len(body.Password) != 64 {
 			logger.WithField("password", len(body.Password)).Trace("Invalid password length")
 			util.Responses.Error(w, http.StatusBadRequest, "field 'password' must be of length 64")
 			return
 		}
 		logger.Trace("Validated JSON body")
 
+		// Ensure not locked out or backing off
+		if wait := throttled(db, accountKey(body.Username), addressKey(remoteIP(r))); wait > 0 {
+			logger.WithFields(logrus.Fields{"username": body.Username, "wait": wait}).Trace("Login attempt throttled")
+			tooManyAttempts(w, wait)
+			return
+		}
+
 		// Check if user exists
 		var user database.User
 		db.Where("username = ?", body.Username).First(&user)
-		if user.ID == 0 {
+		if user.ID == 0 && !useLDAP(user) {
+			recordFailure(db, accountKey(body.Username), accountPolicy())
+			recordFailure(db, addressKey(remoteIP(r)), addressPolicy())
 			logger.WithField("username", body.Username).Trace("Username not found in database")
 			util.Responses.Error(w, http.StatusUnauthorized, "invalid username or password")
 			return
@@ -67,20 +80,64 @@ func Login(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 		// Add username to logger
 		logger = logger.WithField("username", body.Username)
 
-		// Validate password
-		newHash, err := passlib.Verify(body.Password, user.Password)
-		if err != nil {
-			logger.Trace("Invalid password for user")
-			util.Responses.Error(w, http.StatusUnauthorized, "invalid username or password")
-			return
-		}
-		logger.Trace("Validated password")
+		// Validate password against the directory or the stored hash
+		if useLDAP(user) {
+			var err error
+			user, err = ldapLogin(db, user, body.Username, body.Password)
+			if err == util.ErrLDAPInvalidCredentials {
+				if user.ID == 0 {
+					recordFailure(db, accountKey(body.Username), accountPolicy())
+					recordFailure(db, addressKey(remoteIP(r)), addressPolicy())
+				} else {
+					loginFailed(db, r, user, accountLocked, mail, logger)
+				}
+				logger.Trace("Invalid directory credentials for user")
+				util.Responses.Error(w, http.StatusUnauthorized, "invalid username or password")
+				return
+			} else if err == util.ErrLDAPNotPermitted {
+				logger.Trace("User not in group required to login")
+				util.Responses.Error(w, http.StatusForbidden, "user is not permitted to login")
+				return
+			} else if err == errLDAPLocalUser {
+				logger.Trace("User is not managed by the directory")
+				util.Responses.Error(w, http.StatusForbidden, "user is not managed by the directory")
+				return
+			} else if err == errLDAPEmailTaken {
+				logger.Trace("Directory email already used by another user")
+				util.Responses.Error(w, http.StatusConflict, "email is already used by another user")
+				return
+			} else if err != nil {
+				logger.WithError(err).Error("Unable to authenticate against directory")
+				util.Responses.Error(w, http.StatusInternalServerError, "failed to authenticate against directory")
+				return
+			}
+			clearThrottle(db, accountKey(user.Username))
+			logger.Trace("Validated directory credentials and synced user")
+		} else {
+			// Clients cannot know which users are in the directory, so they always send the password
+			// as-is when one is used and it is hashed the same way clients do for local users
+			password := body.Password
+			if viper.GetString("auth.backend") != "local" {
+				digest := sha256.Sum256([]byte(body.Password))
+				password = hex.EncodeToString(digest[:])
+			}
+
+			newHash, err := passlib.Verify(password, user.Password)
+			if err != nil {
+				loginFailed(db, r, user, accountLocked, mail, logger)
+				logger.Trace("Invalid password for user")
+				util.Responses.Error(w, http.StatusUnauthorized, "invalid username or password")
+				return
+			}
+			clearThrottle(db, accountKey(user.Username))
+			logger.Trace("Validated password")
 
-		// Update password hash if needed
-		if newHash != "" {
-			logger.Trace("New hash generated for user")
-			user.Password = newHash
-			db.Save(&user)
+			// Update password hash if needed
+			if newHash != "" {
+				logger.Trace("New hash generated for user")
+				user.Password = newHash
+				db.Save(&user)
+			}
 		}
 
 		// Ensure user is verified
@@ -90,45 +147,34 @@ func Login(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Create signing key for JWT
-		signingKey := make([]byte, 128)
-		if _, err := rand.Read(signingKey); err != nil {
-			logger.WithError(err).Error("Unable to generate JWT signing key")
-			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate JWT signing key")
+		// Generate tokens for a new session, or a pending token if a second factor is required
+		tokens, err := loginTokens(db, user, r)
+		if err == errUserDisabled {
+			logger.Trace("User account is disabled")
+			util.Responses.Error(w, http.StatusForbidden, "user account is disabled")
 			return
-		}
-		logger.Trace("Generated new signing key bytes for JWT")
-
-		// Save key to database
-		storedToken := database.Token{
-			SigningKey: base64.StdEncoding.EncodeToString(signingKey),
-			UserId:     user.ID,
-			Type:       database.TokenAuthentication,
-		}
-		db.NewRecord(storedToken)
-		db.Create(&storedToken)
-		logger.Trace("Stored signing key and user id in database")
-
-		// Generate token with claims
-		token := jwt.NewWithClaims(jwt.SigningMethodHS512, &jwt.StandardClaims{
-			ExpiresAt: time.Now().Unix() + tokenExpiration,
-			IssuedAt:  time.Now().Unix(),
-			NotBefore: time.Now().Unix(),
-			Subject:   fmt.Sprint(user.ID),
-		})
-		token.Header["kid"] = storedToken.ID
-		logger.Trace("Generated JWT claims")
-
-		// Sign token
-		signed, err := token.SignedString(signingKey)
-		if err != nil {
-			logger.WithError(err).Error("Unable to sign JWT")
-			util.Responses.Error(w, http.StatusInternalServerError, "failed to sign JWT")
+		} else if err != nil {
+			logger.WithError(err).Error("Unable to generate session tokens")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate tokens")
 			return
 		}
-		logger.Trace("Signed JWT with signing key")
+		logger.Trace("Generated login tokens")
 
-		util.Responses.SuccessWithData(w, map[string]string{"token": signed})
+		util.Responses.SuccessWithData(w, tokens)
 		logger.Debug("New login from user")
 	}
 }
+
+// Record a failed login attempt for a user, notifying them if their account gets locked
+func loginFailed(db *gorm.DB, r *http.Request, user database.User, accountLocked *template.Template, mail chan *gomail.Message, logger *logrus.Entry) {
+	recordFailure(db, addressKey(remoteIP(r)), addressPolicy())
+	if !recordFailure(db, accountKey(user.Username), accountPolicy()) {
+		return
+	}
+
+	if err := sendAccountLocked(user, accountLocked, mail); err != nil {
+		logger.WithError(err).Error("Unable to send account locked email")
+		return
+	}
+	logger.Info("Locked account after too many failed login attempts")
+}
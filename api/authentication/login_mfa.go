@@ -0,0 +1,78 @@
+package authentication
+
+import (
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/gobuffalo/packr/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/gomail.v2"
+	"net/http"
+)
+
+// Complete a login for users with two-factor authentication given a code or recovery code
+func LoginMFA(db *gorm.DB, mail chan *gomail.Message, box *packr.Box) func(w http.ResponseWriter, r *http.Request) {
+	// Load email templates
+	accountLocked := accountLockedTemplate(box)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/login/mfa", "method": "POST"})
+
+		// Validate request on method
+		if r.Method != http.MethodPost {
+			logger.WithField("method", r.Method).Trace("Invalid request method")
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		// Validate body
+		body, ok := decodeMFABody(w, r, logger)
+		if !ok {
+			return
+		}
+
+		// Get the user from the pending token
+		user, ok := tokenUser(w, r, db, logger)
+		if !ok {
+			return
+		}
+		logger = logger.WithField("username", user.Username)
+
+		// Ensure not locked out or backing off
+		if wait := throttled(db, accountKey(user.Username), addressKey(remoteIP(r))); wait > 0 {
+			logger.WithField("wait", wait).Trace("Login attempt throttled")
+			tooManyAttempts(w, wait)
+			return
+		}
+
+		// Validate second factor
+		if !user.TOTPEnabled || !verifySecondFactor(db, &user, body.Code, body.RecoveryCode) {
+			loginFailed(db, r, user, accountLocked, mail, logger)
+			logger.Trace("Invalid second factor")
+			util.Responses.Error(w, http.StatusUnauthorized, "invalid two-factor authentication code")
+			return
+		}
+		clearThrottle(db, accountKey(user.Username))
+		logger.Trace("Validated second factor")
+
+		// Pending token can only be used once
+		token, _ := util.JWT.Unvalidated(r.Header.Get("Authorization"))
+		util.JWT.Revoke(db, "id = ?", util.JWT.TokenId(token))
+		logger.Trace("Deleted pending two-factor token")
+
+		// Generate tokens for a new session
+		tokens, err := newSession(db, user, r)
+		if err == errUserDisabled {
+			logger.Trace("User account is disabled")
+			util.Responses.Error(w, http.StatusForbidden, "user account is disabled")
+			return
+		} else if err != nil {
+			logger.WithError(err).Error("Unable to generate session tokens")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate tokens")
+			return
+		}
+		logger.Trace("Generated authentication and refresh tokens")
+
+		util.Responses.SuccessWithData(w, tokens)
+		logger.Debug("New login from user with second factor")
+	}
+}
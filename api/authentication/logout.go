@@ -22,11 +22,18 @@ func Logout(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 		}
 		logger.Trace("Got unvalidated token")
 
-		// Delete token row from database
+		// Revoke given token
 		var storedToken database.Token
-		db.Where("id = ?", token.Header["kid"]).First(&storedToken)
-		db.Delete(&storedToken)
-		logger.Trace("Deleted given token")
+		db.Where("id = ?", util.JWT.TokenId(token)).First(&storedToken)
+		util.JWT.Revoke(db, "id = ?", storedToken.ID)
+		logger.Trace("Revoked given token")
+
+		// Revoke remaining tokens and delete session information
+		if storedToken.Family != "" {
+			util.JWT.Revoke(db, "family = ?", storedToken.Family)
+			db.Delete(database.Session{}, "uuid = ?", storedToken.Family)
+			logger.WithField("family", storedToken.Family).Trace("Deleted refresh tokens and session")
+		}
 
 		util.Responses.Success(w)
 		logger.Debug("Revoked authentication token")
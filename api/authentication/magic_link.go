@@ -0,0 +1,256 @@
+package authentication
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/gobuffalo/packr/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// Seconds a sign in link is valid for
+const magicLinkExpiration = 60 * 10
+
+// Email a one-time sign in link to a user
+func MagicLink(db *gorm.DB, mail chan *gomail.Message, box *packr.Box) func(w http.ResponseWriter, r *http.Request) {
+	// Load email templates
+	templateString, err := box.FindString("magic-link.tmpl")
+	if err != nil {
+		logrus.WithError(err).Fatal("Unable to load magic link template from box")
+	}
+	magicLinkTemplate, err := template.New("magic-link-email").Parse(templateString)
+	if err != nil {
+		logrus.WithError(err).Fatal("Unable to load magic link template")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/magic-link", "method": "POST"})
+
+		// Validate initial request on method, Content-Type header and body
+		if r.Method != http.MethodPost {
+			logger.WithField("method", r.Method).Trace("Invalid request method")
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		} else if r.Header.Get("Content-Type") != "application/json" {
+			logger.WithField("content_type", r.Header.Get("Content-Type")).Trace("Invalid content type")
+			util.Responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+			return
+		} else if r.Body == nil {
+			logger.Trace("No request body given")
+			util.Responses.Error(w, http.StatusBadRequest, "request body must exist")
+			return
+		}
+		logger.Trace("Validated initial request")
+
+		// Validate JSON body
+		var body struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			logger.WithError(err).Trace("Invalid json body")
+			util.Responses.Error(w, http.StatusBadRequest, "unable to decode JSON: "+err.Error())
+			return
+		} else if body.Email == "" {
+			logger.Trace("Field email not given")
+			util.Responses.Error(w, http.StatusBadRequest, "field 'email' is required")
+			return
+		}
+		logger.Trace("Validated JSON body")
+
+		// Ensure requests are not being sent too often from the address
+		if wait := throttled(db, addressKey(remoteIP(r))); wait > 0 {
+			logger.WithField("wait", wait).Trace("Magic link request throttled")
+			tooManyAttempts(w, wait)
+			return
+		}
+
+		// Generate nonce binding the link to the requesting device
+		nonce := randomString()
+		if nonce == "" {
+			logger.Error("Unable to generate nonce")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate nonce")
+			return
+		}
+
+		// Check if user exists, responding the same either way so emails cannot be discovered
+		var user database.User
+		db.Where("email = ?", body.Email).First(&user)
+		if user.ID == 0 {
+			recordFailure(db, addressKey(remoteIP(r)), addressPolicy())
+			logger.WithField("email", body.Email).Trace("Email not found in database")
+			util.Responses.SuccessWithData(w, map[string]string{"nonce": nonce})
+			return
+		} else if useLDAP(user) {
+			logger.WithField("username", user.Username).Trace("Directory users must login with their password")
+			util.Responses.SuccessWithData(w, map[string]string{"nonce": nonce})
+			return
+		}
+
+		// Add username to logger
+		logger = logger.WithField("username", user.Username)
+
+		// Ensure emails are not being sent too often
+		if wait := throttled(db, emailKey(user.Username)); wait > 0 {
+			logger.WithField("wait", wait).Trace("Magic link request throttled")
+			tooManyAttempts(w, wait)
+			return
+		}
+		recordFailure(db, emailKey(user.Username), emailPolicy())
+
+		// Generate magic link token
+		signed, err := util.JWT.Create(&database.Token{
+			Type:   database.TokenMagicLink,
+			UserId: user.ID,
+			Nonce:  hashNonce(nonce),
+		}, magicLinkExpiration, db)
+		if err != nil {
+			logger.WithError(err).Error("Unable to generate magic link token")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate magic link token")
+			return
+		}
+		logger.Trace("Generated magic link token")
+
+		// Render template to string
+		stringBuffer := bytes.NewBuffer([]byte{})
+		if err := magicLinkTemplate.Execute(stringBuffer, map[string]string{"name": user.Name, "domain": viper.GetString("http.domain"), "token": signed, "minutes": strconv.Itoa(magicLinkExpiration / 60)}); err != nil {
+			logger.WithError(err).Error("Unable to render template")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate email")
+			return
+		}
+
+		// Assemble and send sign in email
+		m := gomail.NewMessage()
+		m.SetHeader("From", viper.GetString("email.sender"))
+		m.SetHeader("To", user.Email)
+		m.SetHeader("Subject", "Chat App - Your Sign In Link")
+		m.SetBody("text/html", stringBuffer.String())
+		mail <- m
+
+		util.Responses.SuccessWithData(w, map[string]string{"nonce": nonce})
+		logger.Debug("Sent magic link to user")
+	}
+}
+
+// Exchange a sign in link and the nonce from the requesting device for authentication tokens
+func VerifyMagicLink(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/magic-link/verify", "method": "POST"})
+
+		// Validate initial request on method, Content-Type header and body
+		if r.Method != http.MethodPost {
+			logger.WithField("method", r.Method).Trace("Invalid request method")
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		} else if r.Header.Get("Content-Type") != "application/json" {
+			logger.WithField("content_type", r.Header.Get("Content-Type")).Trace("Invalid content type")
+			util.Responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+			return
+		} else if r.Body == nil {
+			logger.Trace("No request body given")
+			util.Responses.Error(w, http.StatusBadRequest, "request body must exist")
+			return
+		}
+		logger.Trace("Validated initial request")
+
+		// Validate JSON body
+		var body struct {
+			Token string `json:"token"`
+			Nonce string `json:"nonce"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			logger.WithError(err).Trace("Invalid json body")
+			util.Responses.Error(w, http.StatusBadRequest, "unable to decode JSON: "+err.Error())
+			return
+		} else if body.Token == "" || body.Nonce == "" {
+			logger.WithFields(logrus.Fields{"token": len(body.Token), "nonce": len(body.Nonce)}).Trace("Field token or nonce not given")
+			util.Responses.Error(w, http.StatusBadRequest, "fields 'token' and 'nonce' are required")
+			return
+		}
+		logger.Trace("Validated JSON body")
+
+		// Ensure not locked out or backing off
+		if wait := throttled(db, addressKey(remoteIP(r))); wait > 0 {
+			logger.WithField("wait", wait).Trace("Magic link verification throttled")
+			tooManyAttempts(w, wait)
+			return
+		}
+
+		// Validate JWT
+		token, err := util.JWT.Validate(body.Token, database.TokenMagicLink, db)
+		if err != nil {
+			recordFailure(db, addressKey(remoteIP(r)), addressPolicy())
+			logger.WithError(err).Trace("Invalid magic link token")
+			util.Responses.Error(w, http.StatusUnauthorized, "invalid token: "+err.Error())
+			return
+		}
+		logger.Trace("Successfully validated magic link token")
+
+		// Ensure link is being used on the device that requested it
+		var storedToken database.Token
+		db.Where("id = ?", util.JWT.TokenId(token)).First(&storedToken)
+		if storedToken.ID == 0 || subtle.ConstantTimeCompare([]byte(storedToken.Nonce), []byte(hashNonce(body.Nonce))) != 1 {
+			recordFailure(db, addressKey(remoteIP(r)), addressPolicy())
+			logger.Trace("Nonce does not match magic link")
+			util.Responses.Error(w, http.StatusUnauthorized, "link must be used on the device that requested it")
+			return
+		}
+
+		// Mark as used so it cannot be exchanged again
+		if db.Model(&database.Token{}).Where("id = ? AND used = ?", storedToken.ID, false).Update("used", true).RowsAffected == 0 {
+			logger.Trace("Magic link already used")
+			util.Responses.Error(w, http.StatusUnauthorized, "invalid token: link has already been used")
+			return
+		}
+		util.JWT.Revoke(db, "id = ?", storedToken.ID)
+		logger.Trace("Consumed magic link token")
+
+		// Get user from token
+		var user database.User
+		db.Where("id = ?", storedToken.UserId).First(&user)
+		if user.ID == 0 {
+			logger.WithField("id", storedToken.UserId).Trace("User not found in database")
+			util.Responses.Error(w, http.StatusBadRequest, "specified user does not exist")
+			return
+		}
+		logger = logger.WithField("username", user.Username)
+
+		// Receiving the link proves ownership of the email
+		if !user.Verified {
+			user.Verified = true
+			db.Save(&user)
+			logger.Trace("Verified user email")
+		}
+
+		// Generate tokens for a new session, or a pending token if a second factor is required
+		tokens, err := loginTokens(db, user, r)
+		if err == errUserDisabled {
+			logger.Trace("User account is disabled")
+			util.Responses.Error(w, http.StatusForbidden, "user account is disabled")
+			return
+		} else if err != nil {
+			logger.WithError(err).Error("Unable to generate session tokens")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate tokens")
+			return
+		}
+		logger.Trace("Generated login tokens")
+
+		util.Responses.SuccessWithData(w, tokens)
+		logger.Debug("New login from user through magic link")
+	}
+}
+
+// Hash a nonce for storage so a database leak cannot be used to complete a login
+func hashNonce(nonce string) string {
+	hash := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(hash[:])
+}
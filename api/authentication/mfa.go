@@ -0,0 +1,304 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+const (
+	mfaExpiration = 60 * 5
+	mfaIssuer     = "Chat App"
+	recoveryCodes = 10
+)
+
+// Methods pertaining to two-factor authentication such as enrolment and removal
+func MFA(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			enrolMFA(w, r, db)
+
+		case http.MethodDelete:
+			disableMFA(w, r, db)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Confirm enrolment in two-factor authentication with a code and generate recovery codes
+func ConfirmMFA(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/mfa/confirm", "method": "POST"})
+
+		// Validate request on method
+		if r.Method != http.MethodPost {
+			logger.WithField("method", r.Method).Trace("Invalid request method")
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		// Validate body
+		body, ok := decodeMFABody(w, r, logger)
+		if !ok {
+			return
+		}
+
+		// Get the requesting user
+		user, ok := tokenUser(w, r, db, logger)
+		if !ok {
+			return
+		}
+		logger = logger.WithField("username", user.Username)
+
+		// Ensure enrolment was started
+		if user.TOTPEnabled {
+			logger.Trace("Two-factor authentication already enabled")
+			util.Responses.Error(w, http.StatusConflict, "two-factor authentication is already enabled")
+			return
+		} else if user.TOTPSecret == "" {
+			logger.Trace("Two-factor authentication enrolment not started")
+			util.Responses.Error(w, http.StatusBadRequest, "two-factor authentication enrolment has not been started")
+			return
+		}
+
+		// Validate code against pending secret
+		step, valid := util.TOTP.Validate(user.TOTPSecret, body.Code, user.TOTPLastStep)
+		if !valid {
+			logger.Trace("Invalid code for pending secret")
+			util.Responses.Error(w, http.StatusUnauthorized, "invalid two-factor authentication code")
+			return
+		}
+		logger.Trace("Validated code for pending secret")
+
+		// Generate recovery codes
+		codes, err := generateRecoveryCodes(db, user)
+		if err != nil {
+			logger.WithError(err).Error("Failed to generate recovery codes")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate recovery codes")
+			return
+		}
+		logger.Trace("Generated recovery codes")
+
+		// Enable two-factor authentication
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		db.Save(&user)
+
+		util.Responses.SuccessWithData(w, map[string][]string{"recovery_codes": codes})
+		logger.Debug("Enabled two-factor authentication for user")
+	}
+}
+
+func enrolMFA(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/mfa", "method": "POST"})
+
+	// Get the requesting user
+	user, ok := tokenUser(w, r, db, logger)
+	if !ok {
+		return
+	}
+	logger = logger.WithField("username", user.Username)
+
+	// Ensure not already enabled
+	if user.TOTPEnabled {
+		logger.Trace("Two-factor authentication already enabled")
+		util.Responses.Error(w, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+
+	// Generate new pending secret
+	secret, err := util.TOTP.Secret()
+	if err != nil {
+		logger.WithError(err).Error("Failed to generate TOTP secret")
+		util.Responses.Error(w, http.StatusInternalServerError, "failed to generate secret")
+		return
+	}
+	user.TOTPSecret = secret
+	user.TOTPLastStep = 0
+	db.Save(&user)
+	logger.Trace("Stored pending TOTP secret")
+
+	util.Responses.SuccessWithData(w, map[string]string{"secret": secret, "url": util.TOTP.URL(secret, mfaIssuer, user.Username)})
+	logger.Debug("Started two-factor authentication enrolment")
+}
+
+func disableMFA(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/mfa", "method": "DELETE"})
+
+	// Validate body
+	body, ok := decodeMFABody(w, r, logger)
+	if !ok {
+		return
+	}
+
+	// Get the requesting user
+	user, ok := tokenUser(w, r, db, logger)
+	if !ok {
+		return
+	}
+	logger = logger.WithField("username", user.Username)
+
+	// Ensure enabled
+	if !user.TOTPEnabled {
+		logger.Trace("Two-factor authentication not enabled")
+		util.Responses.Error(w, http.StatusBadRequest, "two-factor authentication is not enabled")
+		return
+	}
+
+	// Require a second factor to disable
+	if !verifySecondFactor(db, &user, body.Code, body.RecoveryCode) {
+		logger.Trace("Invalid second factor")
+		util.Responses.Error(w, http.StatusUnauthorized, "invalid two-factor authentication code")
+		return
+	}
+
+	// Remove secret and recovery codes
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	db.Save(&user)
+	db.Delete(database.RecoveryCode{}, "user_id = ?", user.ID)
+
+	util.Responses.Success(w)
+	logger.Debug("Disabled two-factor authentication for user")
+}
+
+// Second factor request body
+type mfaBody struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// Validate the request headers and decode the second factor body
+func decodeMFABody(w http.ResponseWriter, r *http.Request, logger *logrus.Entry) (mfaBody, bool) {
+	var body mfaBody
+
+	// Validate headers and body
+	if r.Header.Get("Content-Type") != "application/json" {
+		logger.WithField("content_type", r.Header.Get("Content-Type")).Trace("Invalid content type")
+		util.Responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+		return body, false
+	} else if r.Body == nil {
+		logger.Trace("No request body given")
+		util.Responses.Error(w, http.StatusBadRequest, "request body must exist")
+		return body, false
+	}
+
+	// Decode JSON body
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.WithError(err).Trace("Invalid json body")
+		util.Responses.Error(w, http.StatusBadRequest, "unable to decode JSON: "+err.Error())
+		return body, false
+	} else if body.Code == "" && body.RecoveryCode == "" {
+		logger.Trace("Field code or recovery_code not given")
+		util.Responses.Error(w, http.StatusBadRequest, "field 'code' or 'recovery_code' is required")
+		return body, false
+	}
+	logger.Trace("Validated JSON body")
+
+	return body, true
+}
+
+// Get the user associated with the request token
+func tokenUser(w http.ResponseWriter, r *http.Request, db *gorm.DB, logger *logrus.Entry) (database.User, bool) {
+	var user database.User
+
+	// Get token w/o validation
+	token, err := util.JWT.Unvalidated(r.Header.Get("Authorization"))
+	if err != nil {
+		logger.WithError(err).Error("Unable to get unvalidated token")
+		util.Responses.Error(w, http.StatusInternalServerError, "failed to get token parts")
+		return user, false
+	}
+
+	// Get user id from token
+	uid, err := util.JWT.UserId(token)
+	if err != nil {
+		logger.WithError(err).Trace("Failed to get user id from token")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return user, false
+	}
+
+	// Get user from database
+	db.Where("id = ?", uid).First(&user)
+	if user.ID == 0 {
+		logger.WithField("uid", uid).Trace("User in token does not exist")
+		util.Responses.Error(w, http.StatusBadRequest, "specified user in token does not exist")
+		return user, false
+	}
+	logger.WithField("uid", uid).Trace("Retrieved user from token")
+
+	return user, true
+}
+
+// Check a TOTP code or one-time recovery code for a user, consuming it if valid
+func verifySecondFactor(db *gorm.DB, user *database.User, code, recoveryCode string) bool {
+	// Check TOTP code
+	if code != "" {
+		step, valid := util.TOTP.Validate(user.TOTPSecret, code, user.TOTPLastStep)
+		if !valid {
+			return false
+		}
+
+		// Prevent code from being replayed, only one concurrent login can move past the step
+		if db.Model(user).Where("totp_last_step < ?", step).Update("totp_last_step", step).RowsAffected != 1 {
+			return false
+		}
+		user.TOTPLastStep = step
+		return true
+	}
+
+	// Check and consume recovery code, only one concurrent login can delete it
+	var stored database.RecoveryCode
+	db.Where("user_id = ? AND code = ?", user.ID, hashRecoveryCode(recoveryCode)).First(&stored)
+	if stored.ID == 0 {
+		return false
+	}
+	return db.Where("id = ?", stored.ID).Delete(database.RecoveryCode{}).RowsAffected == 1
+}
+
+// Replace all of a user's recovery codes with newly generated ones
+func generateRecoveryCodes(db *gorm.DB, user database.User) ([]string, error) {
+	// Remove existing codes
+	db.Delete(database.RecoveryCode{}, "user_id = ?", user.ID)
+
+	var codes []string
+	for i := 0; i < recoveryCodes; i++ {
+		// Generate random code
+		raw := make([]byte, 6)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(raw)[:10]
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+
+		// Store hashed code
+		stored := database.RecoveryCode{
+			UserId: user.ID,
+			Code:   hashRecoveryCode(code),
+		}
+		db.NewRecord(stored)
+		db.Create(&stored)
+	}
+
+	return codes, nil
+}
+
+// Normalize and hash a recovery code for storage
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToUpper(strings.Replace(code, "-", "", -1))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
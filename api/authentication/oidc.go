@@ -0,0 +1,252 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How long a user has to login at the provider
+const oidcStateExpiration = 10 * time.Minute
+
+// Start logging in with an OpenID Connect provider by redirecting to it
+func OIDC(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/oidc/{provider}", "method": "GET"})
+
+		// Validate request on method
+		if r.Method != http.MethodGet {
+			logger.WithField("method", r.Method).Trace("Invalid request method")
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		// Get the provider
+		provider, err := util.OIDC.Provider(mux.Vars(r)["provider"])
+		if err != nil {
+			logger.WithError(err).WithField("provider", mux.Vars(r)["provider"]).Trace("Unable to get provider")
+			util.Responses.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logger = logger.WithField("provider", provider.Name)
+
+		// Remove abandoned logins
+		db.Unscoped().Delete(database.OIDCState{}, "created_at < ?", time.Now().Add(-oidcStateExpiration))
+
+		// Generate state, nonce and PKCE verifier
+		state := database.OIDCState{
+			State:    randomString(),
+			Provider: provider.Name,
+			Verifier: randomString(),
+			Nonce:    randomString(),
+		}
+		if state.State == "" || state.Verifier == "" || state.Nonce == "" {
+			logger.Error("Unable to generate random state")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate state")
+			return
+		}
+		db.NewRecord(state)
+		db.Create(&state)
+		logger.Trace("Stored login state")
+
+		// Send user to provider
+		challenge := sha256.Sum256([]byte(state.Verifier))
+		http.Redirect(w, r, provider.AuthorizationURL(oidcRedirectURI(provider.Name), state.State, state.Nonce, base64.RawURLEncoding.EncodeToString(challenge[:])), http.StatusFound)
+		logger.Debug("Redirected user to provider")
+	}
+}
+
+// Finish logging in with an OpenID Connect provider after it redirects back
+func OIDCCallback(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/oidc/{provider}/callback", "method": "GET"})
+
+		// Validate request on method and query parameters
+		query := r.URL.Query()
+		if r.Method != http.MethodGet {
+			logger.WithField("method", r.Method).Trace("Invalid request method")
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		} else if query.Get("error") != "" {
+			logger.WithFields(logrus.Fields{"error": query.Get("error"), "description": query.Get("error_description")}).Trace("Provider returned error")
+			util.Responses.Error(w, http.StatusUnauthorized, "provider returned error: "+query.Get("error"))
+			return
+		} else if query.Get("code") == "" || query.Get("state") == "" {
+			logger.WithFields(logrus.Fields{"code": len(query.Get("code")), "state": query.Get("state")}).Trace("Invalid query parameters")
+			util.Responses.Error(w, http.StatusBadRequest, "query parameters 'code' and 'state' are required")
+			return
+		}
+		logger.Trace("Validated request")
+
+		// Get the provider
+		provider, err := util.OIDC.Provider(mux.Vars(r)["provider"])
+		if err != nil {
+			logger.WithError(err).WithField("provider", mux.Vars(r)["provider"]).Trace("Unable to get provider")
+			util.Responses.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logger = logger.WithField("provider", provider.Name)
+
+		// Get and consume login state
+		var state database.OIDCState
+		db.Where("state = ? AND provider = ? AND created_at > ?", query.Get("state"), provider.Name, time.Now().Add(-oidcStateExpiration)).First(&state)
+		if state.ID == 0 || db.Unscoped().Delete(&state).RowsAffected == 0 {
+			logger.Trace("Invalid or expired login state")
+			util.Responses.Error(w, http.StatusBadRequest, "invalid or expired login state")
+			return
+		}
+		logger.Trace("Consumed login state")
+
+		// Exchange code for verified identity
+		idToken, err := provider.Exchange(query.Get("code"), oidcRedirectURI(provider.Name), state.Verifier)
+		if err != nil {
+			logger.WithError(err).Warn("Unable to exchange authorization code")
+			util.Responses.Error(w, http.StatusUnauthorized, "failed to exchange authorization code")
+			return
+		}
+		claims, err := provider.Verify(idToken, state.Nonce)
+		if err != nil {
+			logger.WithError(err).Warn("Invalid id token from provider")
+			util.Responses.Error(w, http.StatusUnauthorized, "invalid id token: "+err.Error())
+			return
+		}
+		subject, _ := claims["sub"].(string)
+		logger = logger.WithField("subject", subject)
+		logger.Trace("Verified identity from provider")
+
+		// Get or create the linked user
+		user, status, err := oidcUser(db, provider.Name, claims)
+		if err != nil {
+			logger.WithError(err).Trace("Unable to link user")
+			util.Responses.Error(w, status, err.Error())
+			return
+		}
+		logger = logger.WithField("username", user.Username)
+
+		// Generate tokens for a new session, or a pending token if a second factor is required
+		tokens, err := loginTokens(db, user, r)
+		if err == errUserDisabled {
+			logger.Trace("User account is disabled")
+			util.Responses.Error(w, http.StatusForbidden, "user account is disabled")
+			return
+		} else if err != nil {
+			logger.WithError(err).Error("Unable to generate session tokens")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate tokens")
+			return
+		}
+		logger.Trace("Generated login tokens")
+
+		// Send tokens to client application if configured
+		if redirect := viper.GetString("oidc.redirect"); redirect != "" {
+			fragment := url.Values{}
+			for key, value := range tokens {
+				fragment.Set(key, value)
+			}
+			http.Redirect(w, r, redirect+"#"+fragment.Encode(), http.StatusFound)
+		} else {
+			util.Responses.SuccessWithData(w, tokens)
+		}
+		logger.Debug("New login from user through provider")
+	}
+}
+
+// Get the user linked to an identity, linking or creating one by verified email if needed
+func oidcUser(db *gorm.DB, provider string, claims map[string]interface{}) (database.User, int, error) {
+	var user database.User
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+	if subject == "" {
+		return user, http.StatusUnauthorized, fmt.Errorf("id token is missing subject")
+	}
+
+	// Use existing link
+	var identity database.OIDCIdentity
+	db.Where("provider = ? AND subject = ?", provider, subject).First(&identity)
+	if identity.ID != 0 {
+		db.Where("id = ?", identity.UserId).First(&user)
+		if user.ID != 0 {
+			return user, 0, nil
+		}
+		db.Unscoped().Delete(&identity)
+	}
+
+	// Linking requires an email the provider has verified
+	if email == "" || !emailVerified {
+		return user, http.StatusForbidden, fmt.Errorf("provider did not give a verified email")
+	}
+
+	// Link to existing user with the same email, as long as they verified it too
+	db.Where("email = ?", email).First(&user)
+	if user.ID != 0 && !user.Verified {
+		return user, http.StatusConflict, fmt.Errorf("email is already used by an unverified user")
+	} else if user.ID == 0 {
+		// Create user without a password so they can only login through the provider
+		name, _ := claims["name"].(string)
+		if name == "" {
+			name = email
+		}
+		preferred, _ := claims["preferred_username"].(string)
+		if preferred == "" {
+			preferred = strings.Split(email, "@")[0]
+		}
+
+		user = database.User{
+			Name:     name,
+			Email:    email,
+			Username: availableUsername(db, preferred),
+			Verified: true,
+		}
+		db.NewRecord(user)
+		db.Create(&user)
+	}
+
+	// Save link to user
+	identity = database.OIDCIdentity{
+		Provider: provider,
+		Subject:  subject,
+		UserId:   user.ID,
+	}
+	db.NewRecord(identity)
+	db.Create(&identity)
+
+	return user, 0, nil
+}
+
+// Get a username that is not taken, adding a number to the end if needed
+func availableUsername(db *gorm.DB, preferred string) string {
+	username := preferred
+	for i := 1; ; i++ {
+		var count int
+		db.Model(&database.User{}).Where("username = ?", username).Count(&count)
+		if count == 0 {
+			return username
+		}
+		username = fmt.Sprintf("%s%d", preferred, i)
+	}
+}
+
+// Get the URL the provider redirects back to
+func oidcRedirectURI(provider string) string {
+	return viper.GetString("http.domain") + "/api/auth/oidc/" + provider + "/callback"
+}
+
+// Generate a random URL safe string, empty if generation fails
+func randomString() string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
@@ -0,0 +1,113 @@
+package authentication
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Exchange a refresh token for a new authentication and refresh token pair
+func Refresh(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/refresh", "method": "POST"})
+
+		// Validate initial request on method, headers, and body
+		if r.Method != http.MethodPost {
+			logger.WithField("method", r.Method).Trace("Invalid request method")
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		} else if r.Header.Get("Content-Type") != "application/json" {
+			logger.WithField("content_type", r.Header.Get("Content-Type")).Trace("Invalid content type")
+			util.Responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+			return
+		} else if r.Body == nil {
+			logger.Trace("No request body given")
+			util.Responses.Error(w, http.StatusBadRequest, "request body must exist")
+			return
+		}
+		logger.Trace("Validated initial request")
+
+		// Validate JSON body
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			logger.WithError(err).Trace("Invalid json body")
+			util.Responses.Error(w, http.StatusBadRequest, "unable to decode JSON: "+err.Error())
+			return
+		} else if body.RefreshToken == "" {
+			logger.Trace("Field refresh_token not given")
+			util.Responses.Error(w, http.StatusBadRequest, "field 'refresh_token' is required")
+			return
+		}
+		logger.Trace("Validated JSON body")
+
+		// Validate refresh token
+		token, err := util.JWT.Validate(body.RefreshToken, database.TokenRefresh, db)
+		if err != nil {
+			logger.WithError(err).Trace("Invalid refresh token")
+			util.Responses.Error(w, http.StatusUnauthorized, "invalid token: "+err.Error())
+			return
+		}
+		logger.Trace("Validated refresh token")
+
+		// Get stored token information
+		var storedToken database.Token
+		db.Where("id = ?", util.JWT.TokenId(token)).First(&storedToken)
+		if storedToken.ID == 0 {
+			logger.WithField("token_id", util.JWT.TokenId(token)).Trace("Refresh token was revoked during request")
+			util.Responses.Error(w, http.StatusUnauthorized, "invalid token: token was revoked")
+			return
+		}
+
+		// Add session family to logger
+		logger = logger.WithFields(logrus.Fields{"family": storedToken.Family, "uid": storedToken.UserId})
+
+		// Mark as used, revoking the entire session if it was already used
+		if db.Model(&database.Token{}).Where("id = ? AND used = ?", storedToken.ID, false).Update("used", true).RowsAffected == 0 {
+			util.JWT.Revoke(db, "family = ?", storedToken.Family)
+			db.Delete(database.Session{}, "uuid = ?", storedToken.Family)
+			logger.Warn("Refresh token reused, revoked all tokens in session")
+			util.Responses.Error(w, http.StatusUnauthorized, "refresh token reuse detected, session revoked")
+			return
+		}
+		logger.Trace("Marked refresh token as used")
+
+		// Revoke previous authentication tokens in session
+		util.JWT.Revoke(db, "family = ? AND type = ?", storedToken.Family, database.TokenAuthentication)
+		logger.Trace("Revoked previous authentication tokens for session")
+
+		// Ensure user still exists
+		var user database.User
+		db.Where("id = ?", storedToken.UserId).First(&user)
+		if user.ID == 0 {
+			logger.Trace("User associated with token does not exist")
+			util.Responses.Error(w, http.StatusUnauthorized, "user associated with token does not exist")
+			return
+		}
+
+		// Update session last used time
+		db.Model(&database.Session{}).Where("uuid = ?", storedToken.Family).Update("last_used", time.Now())
+		logger.Trace("Updated session last used time")
+
+		// Generate rotated tokens
+		tokens, err := issueTokens(db, user, storedToken.Family)
+		if err == errUserDisabled {
+			logger.Trace("User account is disabled")
+			util.Responses.Error(w, http.StatusForbidden, "user account is disabled")
+			return
+		} else if err != nil {
+			logger.WithError(err).Error("Unable to generate session tokens")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate tokens")
+			return
+		}
+		logger.Trace("Generated rotated authentication and refresh tokens")
+
+		util.Responses.SuccessWithData(w, tokens)
+		logger.Debug("Refreshed session tokens")
+	}
+}
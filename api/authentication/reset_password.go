@@ -92,7 +92,7 @@ func ResetPassword(db *gorm.DB, mail chan *gomail.Message, box *packr.Box) func(
 		logger.Trace("User password updated")
 
 		// Revoke token
-		db.Delete(database.Token{}, "id = ?", token.Header["kid"])
+		util.JWT.Revoke(db, "id = ?", util.JWT.TokenId(token))
 		logger.Trace("Deleted associated signing key")
 
 		// Render template to string
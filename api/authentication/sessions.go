@@ -0,0 +1,166 @@
+package authentication
+
+import (
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Methods pertaining to all of a user's sessions such as listing and bulk revocation
+func Sessions(hub *websockets.Hub, db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listSessions(w, r, db)
+
+		case http.MethodDelete:
+			revokeOtherSessions(w, r, hub, db)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Methods pertaining to a specific session such as revocation
+func SpecificSession(hub *websockets.Hub, db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodDelete:
+			revokeSession(w, r, hub, db)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/sessions", "method": "GET"})
+
+	// Get the requesting user and their current session
+	uid, current, err := currentSession(r, db)
+	if err != nil {
+		logger.WithError(err).Trace("Failed to get current session from token")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger = logger.WithField("uid", uid)
+
+	// Get all sessions that could still be refreshed
+	var sessions []database.Session
+	db.Where("user_id = ? AND last_used > ?", uid, time.Now().Add(-refreshExpiration*time.Second)).Order("last_used desc").Find(&sessions)
+	logger.WithField("count", len(sessions)).Trace("Retrieved active sessions for user")
+
+	// Convert to response format
+	response := []map[string]interface{}{}
+	for _, session := range sessions {
+		response = append(response, map[string]interface{}{
+			"id":         session.UUID,
+			"created_at": session.CreatedAt.Unix(),
+			"last_used":  session.LastUsed.Unix(),
+			"user_agent": session.UserAgent,
+			"ip_address": session.IPAddress,
+			"current":    session.UUID == current,
+		})
+	}
+
+	util.Responses.SuccessWithData(w, response)
+	logger.Debug("Retrieved list of sessions for user")
+}
+
+func revokeSession(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/sessions/{session}", "method": "DELETE"})
+
+	// Validate initial request on path parameters
+	vars := mux.Vars(r)
+	if _, ok := vars["session"]; !ok {
+		logger.WithField("session", vars["session"]).Trace("Invalid value for path parameter")
+		util.Responses.Error(w, http.StatusBadRequest, "path parameter 'session' must be present")
+		return
+	}
+	logger = logger.WithField("session", vars["session"])
+
+	// Get the requesting user
+	uid, _, err := currentSession(r, db)
+	if err != nil {
+		logger.WithError(err).Trace("Failed to get current session from token")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger = logger.WithField("uid", uid)
+
+	// Ensure session exists and belongs to the user
+	var session database.Session
+	db.Where("uuid = ? AND user_id = ?", vars["session"], uid).First(&session)
+	if session.ID == 0 {
+		logger.Trace("Specified session does not exist")
+		util.Responses.Error(w, http.StatusBadRequest, "specified session does not exist")
+		return
+	}
+
+	endSession(db, hub, session)
+
+	util.Responses.Success(w)
+	logger.Debug("Revoked specified session")
+}
+
+func revokeOtherSessions(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/sessions", "method": "DELETE"})
+
+	// Get the requesting user and their current session
+	uid, current, err := currentSession(r, db)
+	if err != nil {
+		logger.WithError(err).Trace("Failed to get current session from token")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger = logger.WithField("uid", uid)
+
+	// Revoke every session except the current one
+	var sessions []database.Session
+	db.Where("user_id = ? AND uuid <> ?", uid, current).Find(&sessions)
+	for _, session := range sessions {
+		endSession(db, hub, session)
+	}
+
+	util.Responses.Success(w)
+	logger.WithField("count", len(sessions)).Debug("Revoked all other sessions for user")
+}
+
+// Get the requesting user id and session id from the request token
+func currentSession(r *http.Request, db *gorm.DB) (uint, string, error) {
+	// Get token w/o validation
+	token, err := util.JWT.Unvalidated(r.Header.Get("Authorization"))
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Get user id from token
+	uid, err := util.JWT.UserId(token)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Get session from stored token
+	var storedToken database.Token
+	db.Where("id = ?", util.JWT.TokenId(token)).First(&storedToken)
+
+	return uid, storedToken.Family, nil
+}
+
+// Revoke all tokens in a session and disconnect its websocket clients
+func endSession(db *gorm.DB, hub *websockets.Hub, session database.Session) {
+	util.JWT.Revoke(db, "family = ?", session.UUID)
+	db.Delete(&session)
+
+	// Get username for disconnection
+	var user database.User
+	db.Where("id = ?", session.UserId).First(&user)
+	hub.CloseSession(user.Username, session.UUID)
+}
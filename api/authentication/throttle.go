@@ -0,0 +1,167 @@
+package authentication
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/gobuffalo/packr/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Limits on failed attempts for a throttle key
+type throttlePolicy struct {
+	// Attempts allowed before backoff begins
+	free uint
+
+	// Initial backoff delay, doubled on each following attempt
+	delay time.Duration
+
+	// Attempts before the key is locked out
+	limit uint
+}
+
+// Policy for login attempts against a single account
+func accountPolicy() throttlePolicy {
+	return throttlePolicy{
+		free:  uint(viper.GetInt("security.backoff_after")),
+		delay: time.Second,
+		limit: uint(viper.GetInt("security.lockout_attempts")),
+	}
+}
+
+// Policy for attempts from a single IP address
+func addressPolicy() throttlePolicy {
+	return throttlePolicy{
+		free:  uint(viper.GetInt("security.backoff_after")),
+		delay: time.Second,
+		limit: uint(viper.GetInt("security.address_lockout_attempts")),
+	}
+}
+
+// Policy for requests that send emails
+func emailPolicy() throttlePolicy {
+	return throttlePolicy{
+		free:  1,
+		delay: time.Minute,
+		limit: uint(viper.GetInt("security.lockout_attempts")),
+	}
+}
+
+// Throttle keys for an account and address
+func accountKey(username string) string { return "account:" + username }
+func addressKey(ip string) string       { return "address:" + ip }
+func emailKey(username string) string   { return "email:" + username }
+
+// Get the IP address of a request without its port
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// Get how long until another attempt is allowed for all of the given keys
+func throttled(db *gorm.DB, keys ...string) time.Duration {
+	var throttles []database.Throttle
+	db.Where("key IN (?)", keys).Find(&throttles)
+
+	var wait time.Duration
+	for _, throttle := range throttles {
+		if remaining := time.Until(throttle.LockedUntil); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
+
+// Record a failed attempt for a key, returning whether the key was locked out by it
+func recordFailure(db *gorm.DB, key string, policy throttlePolicy) bool {
+	lockout := time.Duration(viper.GetInt("security.lockout_duration")) * time.Second
+
+	// Count the attempt atomically, forgetting earlier attempts if they are old enough, so concurrent
+	// attempts are all counted and the first attempts for a key cannot race to create it
+	now := time.Now()
+	var throttle database.Throttle
+	if err := db.Raw(`INSERT INTO throttles (created_at, updated_at, key, attempts, last_attempt, locked_until) VALUES (?, ?, ?, 1, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET updated_at = EXCLUDED.updated_at, last_attempt = EXCLUDED.last_attempt,
+		attempts = CASE WHEN throttles.last_attempt < ? THEN 1 ELSE throttles.attempts + 1 END
+		RETURNING id, attempts`, now, now, key, now, time.Time{}, now.Add(-lockout)).Row().Scan(&throttle.ID, &throttle.Attempts); err != nil || throttle.ID == 0 {
+		logrus.WithFields(logrus.Fields{"app": "throttle", "key": key}).WithError(err).Error("Failed to record failed attempt")
+		return false
+	}
+
+	// Lock out once the limit is reached
+	if throttle.Attempts >= policy.limit {
+		db.Model(&throttle).UpdateColumns(map[string]interface{}{"attempts": 0, "locked_until": time.Now().Add(lockout)})
+		logrus.WithFields(logrus.Fields{"app": "throttle", "key": key, "duration": lockout}).Warn("Locked out key after too many failed attempts")
+		return true
+	}
+
+	// Exponentially back off after the free attempts
+	if throttle.Attempts > policy.free {
+		delay := float64(policy.delay) * math.Pow(2, float64(throttle.Attempts-policy.free-1))
+		db.Model(&throttle).UpdateColumn("locked_until", time.Now().Add(time.Duration(math.Min(delay, float64(lockout)))))
+	}
+
+	return false
+}
+
+// Remove all failed attempts for a key
+func clearThrottle(db *gorm.DB, key string) {
+	db.Unscoped().Delete(database.Throttle{}, "key = ?", key)
+}
+
+// Remove all lockouts and failed attempts for a user, returning whether any existed
+func Unlock(db *gorm.DB, username string) bool {
+	return db.Unscoped().Delete(database.Throttle{}, "key IN (?)", []string{accountKey(username), emailKey(username)}).RowsAffected > 0
+}
+
+// Respond that too many attempts have been made
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	util.Responses.Error(w, http.StatusTooManyRequests, "too many attempts, try again later")
+}
+
+// Load the account locked email template
+func accountLockedTemplate(box *packr.Box) *template.Template {
+	templateString, err := box.FindString("account-locked.tmpl")
+	if err != nil {
+		logrus.WithError(err).Fatal("Unable to load account locked template from box")
+	}
+	accountLocked, err := template.New("account-locked-email").Parse(templateString)
+	if err != nil {
+		logrus.WithError(err).Fatal("Unable to load account locked template")
+	}
+	return accountLocked
+}
+
+// Notify a user that their account was locked
+func sendAccountLocked(user database.User, accountLocked *template.Template, mail chan *gomail.Message) error {
+	// Render template to string
+	duration := time.Duration(viper.GetInt("security.lockout_duration")) * time.Second
+	stringBuffer := bytes.NewBuffer([]byte{})
+	if err := accountLocked.Execute(stringBuffer, map[string]string{"name": user.Name, "duration": fmt.Sprintf("%d minutes", int(duration.Minutes()))}); err != nil {
+		return err
+	}
+
+	// Assemble and send email
+	m := gomail.NewMessage()
+	m.SetHeader("From", viper.GetString("email.sender"))
+	m.SetHeader("To", user.Email)
+	m.SetHeader("Subject", "Chat App - Your Account was Locked")
+	m.SetBody("text/html", stringBuffer.String())
+	mail <- m
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package authentication
+
+import (
+	"errors"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"net/http"
+	"time"
+)
+
+const refreshExpiration = 60 * 60 * 24 * 30
+
+// Tokens cannot be issued to a user that was disabled by an administrator
+var errUserDisabled = errors.New("user account is disabled")
+
+// Generate the tokens returned from logging in.
+// If the user has two-factor authentication enabled, only a pending token is returned.
+func loginTokens(db *gorm.DB, user database.User, r *http.Request) (map[string]string, error) {
+	if user.Disabled {
+		return nil, errUserDisabled
+	} else if !user.TOTPEnabled {
+		return newSession(db, user, r)
+	}
+
+	mfaToken, err := util.JWT.Create(&database.Token{
+		Type:   database.TokenMFAPending,
+		UserId: user.ID,
+	}, mfaExpiration, db)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"mfa_token": mfaToken}, nil
+}
+
+// Create a new login session for the user and generate its tokens
+func newSession(db *gorm.DB, user database.User, r *http.Request) (map[string]string, error) {
+	if user.Disabled {
+		return nil, errUserDisabled
+	}
+
+	// Save session information
+	session := database.Session{
+		UUID:      uuid.NewV4().String(),
+		UserId:    user.ID,
+		UserAgent: r.UserAgent(),
+		IPAddress: remoteIP(r),
+		LastUsed:  time.Now(),
+	}
+	db.NewRecord(session)
+	db.Create(&session)
+
+	return issueTokens(db, user, session.UUID)
+}
+
+// Generate an authentication and refresh token pair belonging to the given session family
+func issueTokens(db *gorm.DB, user database.User, family string) (map[string]string, error) {
+	if user.Disabled {
+		return nil, errUserDisabled
+	}
+
+	// Generate authentication token
+	authToken, err := util.JWT.Create(&database.Token{
+		Type:   database.TokenAuthentication,
+		UserId: user.ID,
+		Family: family,
+	}, tokenExpiration, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate refresh token
+	refreshToken, err := util.JWT.Create(&database.Token{
+		Type:   database.TokenRefresh,
+		UserId: user.ID,
+		Family: family,
+	}, refreshExpiration, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"token": authToken, "refresh_token": refreshToken}, nil
+}
@@ -1,13 +1,19 @@
 package authentication
 
 import (
+	"bytes"
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/gobuffalo/packr/v2"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
+	"html/template"
 	"net/http"
 )
 
+// Verify a user's email, or confirm a change to a new email, using the token sent to it
 func VerifyEmail(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/verify-email", "method": "GET"})
@@ -24,8 +30,16 @@ func VerifyEmail(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 		}
 		logger.Trace("Validated request")
 
+		// Get the type of verification from the token
+		tokenType := database.TokenVerification
+		if unvalidated, err := util.JWT.Unvalidated(r.URL.Query().Get("token")); err == nil {
+			if claims := util.JWT.Claims(unvalidated); claims != nil && claims["type"] == float64(database.TokenChangeEmail) {
+				tokenType = database.TokenChangeEmail
+			}
+		}
+
 		// Validate JWT
-		token, err := util.JWT.Validate(r.URL.Query().Get("token"), database.TokenVerification, db)
+		token, err := util.JWT.Validate(r.URL.Query().Get("token"), tokenType, db)
 		if err != nil {
 			util.Responses.Error(w, http.StatusUnauthorized, "invalid token: "+err.Error())
 			return
@@ -45,14 +59,129 @@ func VerifyEmail(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 		// Add user to logger
 		logger = logger.WithField("username", user.Username)
 
+		// Apply pending email change
+		if tokenType == database.TokenChangeEmail {
+			if user.PendingEmail == "" {
+				logger.Trace("No pending email change")
+				util.Responses.Error(w, http.StatusBadRequest, "no pending email change")
+				return
+			}
+
+			// Ensure email was not taken while pending
+			var count int
+			db.Model(&database.User{}).Where("email = ? AND id <> ?", user.PendingEmail, user.ID).Count(&count)
+			if count != 0 {
+				logger.WithField("email", user.PendingEmail).Trace("Pending email is already taken")
+				util.Responses.Error(w, http.StatusConflict, "email is already taken")
+				return
+			}
+
+			user.Email = user.PendingEmail
+			user.PendingEmail = ""
+			logger.Trace("Applied pending email change")
+		}
+
 		// Set as verified
 		user.Verified = true
 		db.Save(&user)
 
 		// Delete verification token
-		db.Delete(database.Token{}, "id = ?", token.Header["kid"])
+		util.JWT.Revoke(db, "id = ?", util.JWT.TokenId(token))
 
 		util.Responses.Success(w)
 		logger.Debug("Successfully verified user email")
 	}
 }
+
+// Send a new verification email to a user that has not verified their email
+func ResendVerification(db *gorm.DB, mail chan *gomail.Message, box *packr.Box) func(w http.ResponseWriter, r *http.Request) {
+	// Load email templates
+	templateString, err := box.FindString("verification.tmpl")
+	if err != nil {
+		logrus.WithError(err).Fatal("Unable to load verification template from box")
+	}
+	emailVerificationTemplate, err := template.New("verification-email").Parse(templateString)
+	if err != nil {
+		logrus.WithError(err).Fatal("Unable to load verification template")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithFields(logrus.Fields{"app": "authentication", "remote_address": r.RemoteAddr, "path": "/api/auth/verify-email/resend", "method": "GET"})
+
+		// Validate request on method and query parameters
+		if r.Method != http.MethodGet {
+			logger.WithField("method", r.Method).Trace("Invalid request method")
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		} else if len(r.URL.RawQuery) == 0 || r.URL.Query().Get("username") == "" {
+			logger.WithField("username", r.URL.Query().Get("username")).Trace("Invalid query parameter")
+			util.Responses.Error(w, http.StatusBadRequest, "query parameter 'username' is required")
+			return
+		}
+		logger.Trace("Validated request")
+
+		// Ensure emails are not being sent too often
+		if wait := throttled(db, emailKey(r.URL.Query().Get("username")), addressKey(remoteIP(r))); wait > 0 {
+			logger.WithFields(logrus.Fields{"username": r.URL.Query().Get("username"), "wait": wait}).Trace("Resend verification request throttled")
+			tooManyAttempts(w, wait)
+			return
+		}
+
+		// Check if user exists
+		var user database.User
+		db.Where("username = ?", r.URL.Query().Get("username")).First(&user)
+		if user.ID == 0 {
+			recordFailure(db, addressKey(remoteIP(r)), addressPolicy())
+			logger.WithField("username", r.URL.Query().Get("username")).Trace("User not found in database")
+			util.Responses.Error(w, http.StatusBadRequest, "specified user does not exist")
+			return
+		}
+
+		// Add username to logger
+		logger = logger.WithField("username", user.Username)
+
+		// Ensure user still needs to verify
+		if user.Verified {
+			logger.Trace("User email already verified")
+			util.Responses.Error(w, http.StatusBadRequest, "user email already verified")
+			return
+		}
+
+		// Count email towards rate limit
+		recordFailure(db, emailKey(user.Username), emailPolicy())
+
+		// Replace any previous verification tokens
+		util.JWT.Revoke(db, "user_id = ? AND type = ?", user.ID, database.TokenVerification)
+
+		// Generate verification token
+		signed, err := util.JWT.Create(&database.Token{
+			Type:   database.TokenVerification,
+			UserId: user.ID,
+		}, tokenExpiration, db)
+		if err != nil {
+			logger.WithError(err).Error("Unable to generate verification token")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate verification token")
+			return
+		}
+		logger.Trace("Generated verification token")
+
+		// Render template to string
+		stringBuffer := bytes.NewBuffer([]byte{})
+		if err := emailVerificationTemplate.Execute(stringBuffer, map[string]string{"name": user.Name, "domain": viper.GetString("http.domain"), "token": signed}); err != nil {
+			logger.WithError(err).Error("Unable to render template")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to generate email")
+			return
+		}
+
+		// Assemble and send verification email
+		m := gomail.NewMessage()
+		m.SetHeader("From", viper.GetString("email.sender"))
+		m.SetHeader("To", user.Email)
+		m.SetHeader("Subject", "Chat App - Verify Your Email")
+		m.SetBody("text/html", stringBuffer.String())
+		mail <- m
+
+		util.Responses.Success(w)
+		logger.Debug("Resent verification email to user")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
 	"github.com/jinzhu/gorm"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
@@ -11,7 +12,7 @@ import (
 	"time"
 )
 
-func create(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+func create(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gorm.DB) {
 	logger := logrus.WithFields(logrus.Fields{"app": "chats", "remote_address": r.RemoteAddr, "path": "/api/chats", "method": "POST"})
 
 	// Validate initial request on headers and body
@@ -105,6 +106,7 @@ func create(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 
 	// Add initial message to chat
 	message := database.Message{
+		UUID:      uuid.NewV4().String(),
 		ChatId:    chat.ID,
 		Sender:    requestingUser,
 		SenderId:  requestingUser.ID,
@@ -127,6 +129,14 @@ func create(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	}
 	logger.Trace("Add all users to chat and chat to users")
 
+	// Make requesting user the owner
+	setMemberRole(db, chat.ID, requestingUser.ID, database.ChatOwner)
+	logger.Trace("Set requesting user as chat owner")
+
+	// Notify members of the new chat
+	loadRoles(db, chat)
+	hub.PushChatEvent(chat.Users, websockets.EventChatCreated, chat.UUID, chat)
+
 	util.Responses.Success(w)
 	logger.WithFields(logrus.Fields{"name": chat.DisplayName, "users": body.Users}).Debug("Created chat with name, users, and initial message")
 }
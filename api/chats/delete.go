@@ -3,13 +3,14 @@ package chats
 import (
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 	"net/http"
 )
 
-func deleteMethod(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+func deleteMethod(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gorm.DB) {
 	logger := logrus.WithFields(logrus.Fields{"app": "chats", "remote_address": r.RemoteAddr, "path": "/api/chats/{chat}", "method": "DELETE"})
 
 	// Validate initial request on path parameters
@@ -62,23 +63,25 @@ func deleteMethod(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	logger.WithField("uid", id).Trace("Retrieved user data from database")
 
 	// Ensure user is in chat
-	valid := false
-	for _, u := range chat.Users {
-		if u.ID == id {
-			valid = true
-			break
-		}
-	}
-	if !valid {
+	role := memberRole(db, chat.ID, id)
+	if role == "" {
 		logger.WithField("uid", id).Trace("User associated with token not in chat")
 		util.Responses.Error(w, http.StatusForbidden, "specified user is not in chat")
 		return
+	} else if role != database.ChatOwner {
+		logger.WithFields(logrus.Fields{"uid": id, "role": role}).Trace("User associated with token is not chat owner")
+		util.Responses.Error(w, http.StatusForbidden, "only the chat owner can delete the chat")
+		return
 	}
-	logger.WithField("uid", id).Trace("Confirmed requesting user in chat")
+	logger.WithField("uid", id).Trace("Confirmed requesting user owns chat")
 
 	// Delete chat and messages
 	db.Delete(database.Message{}, "chat_id = ?", chat.ID)
 	db.Delete(&chat)
+	db.Delete(database.UserChat{}, "chat_id = ?", chat.ID)
+
+	// Notify members of the deletion
+	hub.PushChatEvent(chat.Users, websockets.EventChatDeleted, chat.UUID, websockets.DeletedEvent{UUID: chat.UUID, DeletedBy: user.Username})
 
 	util.Responses.Success(w)
 	logger.Debug("Deleted chat and all messages")
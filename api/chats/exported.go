@@ -2,16 +2,17 @@ package chats
 
 import (
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
 	"github.com/jinzhu/gorm"
 	"net/http"
 )
 
 // Methods pertaining to all chats such as listing and creation
-func AllChats(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+func AllChats(hub *websockets.Hub, db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
-			create(w, r, db)
+			create(w, r, hub, db)
 
 		case http.MethodGet:
 			list(w, r, db)
@@ -23,17 +24,43 @@ func AllChats(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 }
 
 // Methods pertaining to specific chats such as description, modification and deletion
-func SpecificChat(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+func SpecificChat(hub *websockets.Hub, db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			read(w, r, db)
 
 		case http.MethodPut:
-			update(w, r, db)
+			update(w, r, hub, db)
 
 		case http.MethodDelete:
-			deleteMethod(w, r, db)
+			deleteMethod(w, r, hub, db)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Remove the requesting user from a chat without deleting it for everyone else
+func LeaveChat(hub *websockets.Hub, db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			leave(w, r, hub, db)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Mark a chat as read up to a message for the requesting user
+func MarkRead(hub *websockets.Hub, db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			markRead(w, r, hub, db)
 
 		default:
 			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
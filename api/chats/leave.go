@@ -0,0 +1,121 @@
+package chats
+
+import (
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+func leave(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "chats", "remote_address": r.RemoteAddr, "path": "/api/chats/{chat}/leave", "method": "POST"})
+
+	// Validate initial request on path parameters
+	vars := mux.Vars(r)
+	if _, ok := vars["chat"]; !ok {
+		logger.WithField("chat", vars["chat"]).Trace("Invalid value for path parameter")
+		util.Responses.Error(w, http.StatusBadRequest, "path parameter 'chat' must be present")
+		return
+	}
+	logger.WithField("chat", vars["chat"]).Trace("Validated initial request on path parameters")
+
+	// Add chat id to logger
+	logger = logger.WithField("chat", vars["chat"])
+
+	// Ensure chat exists
+	var chat database.Chat
+	db.Preload("Users").Where("uuid = ?", vars["chat"]).First(&chat)
+	if chat.ID == 0 {
+		logger.Trace("Specified chat does not exist")
+		util.Responses.Error(w, http.StatusBadRequest, "specified chat does not exist")
+		return
+	}
+	logger.Trace("Retrieved chat information from database")
+
+	// Get token w/o validation
+	token, err := util.JWT.Unvalidated(r.Header.Get("Authorization"))
+	if err != nil {
+		logger.WithError(err).Error("Unable to get unvalidated token")
+		util.Responses.Error(w, http.StatusInternalServerError, "failed to get token parts")
+		return
+	}
+	logger.Trace("Got unvalidated token parts")
+
+	// Get user id from token
+	id, err := util.JWT.UserId(token)
+	if err != nil {
+		logger.WithError(err).Trace("Failed to get user id from token")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger.WithField("uid", id).Trace("Got user id from token")
+
+	// Ensure user is in chat
+	var user database.User
+	for _, u := range chat.Users {
+		if u.ID == id {
+			user = u
+			break
+		}
+	}
+	role := memberRole(db, chat.ID, id)
+	if user.ID == 0 || role == "" {
+		logger.WithField("uid", id).Trace("User associated with token not in chat")
+		util.Responses.Error(w, http.StatusForbidden, "specified user is not in chat")
+		return
+	}
+	logger.WithFields(logrus.Fields{"uid": id, "role": role}).Trace("Confirmed requesting user in chat")
+
+	// Remove user from chat
+	db.Model(&chat).Association("Users").Delete(&user)
+	logger.Trace("Removed association between user and chat")
+
+	// Delete the chat once nobody is left in it
+	var remaining int
+	db.Model(&database.UserChat{}).Where("chat_id = ?", chat.ID).Count(&remaining)
+	if remaining == 0 {
+		db.Delete(database.Message{}, "chat_id = ?", chat.ID)
+		db.Delete(&chat)
+		hub.PushEvent(user, websockets.EventChatMemberRemoved, chat.UUID, websockets.MemberEvent{User: user.Username, Reason: websockets.RemovedLeft})
+		util.Responses.Success(w)
+		logger.Debug("Last member left, deleted chat and all messages")
+		return
+	}
+
+	// Hand over ownership so the chat can still be managed
+	if role == database.ChatOwner {
+		successor := promoteSuccessor(db, chat.ID)
+		logger.WithField("successor", successor).Trace("Transferred ownership of chat")
+	}
+
+	// Record the departure in the chat
+	message := database.Message{
+		UUID:      uuid.NewV4().String(),
+		ChatId:    chat.ID,
+		SenderId:  user.ID,
+		Type:      database.MessageSystem,
+		Message:   user.Username + " left the chat",
+		Timestamp: time.Now().UnixNano(),
+	}
+	db.NewRecord(message)
+	db.Create(&message)
+	logger.Trace("Added system message for departure")
+
+	// Notify the remaining members, and the leaving user so their other connections drop the chat,
+	// the association was already removed from the chat's users
+	hub.PushChatEvent(append(chat.Users, user), websockets.EventChatMemberRemoved, chat.UUID, websockets.MemberEvent{User: user.Username, Reason: websockets.RemovedLeft})
+
+	// Only the remaining members receive the system message
+	message.Sender = user
+	for _, u := range chat.Users {
+		hub.PushMessage(u, message, chat.UUID)
+	}
+
+	util.Responses.Success(w)
+	logger.Debug("Removed user from chat")
+}
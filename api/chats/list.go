@@ -32,11 +32,15 @@ func list(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 		return
 	}
 
-	// Get most recent message for each chat
+	// Get most recent message, member roles and unread counts for each chat
+	counts := countUnread(db, user.ID)
 	for index, chat := range user.Chats {
 		user.Chats[index].Messages = []database.Message{chat.Messages[len(chat.Messages)-1]}
+		user.Chats[index].Unread = counts[chat.ID].Unread
+		user.Chats[index].Mentions = counts[chat.ID].Mentions
+		loadRoles(db, &user.Chats[index])
 	}
-	logger.Trace("Set most recent message to only message in chat")
+	logger.Trace("Set most recent message to only message in chat and added roles and unread counts")
 
 	util.Responses.SuccessWithData(w, user.Chats)
 	logger.WithFields(logrus.Fields{"chats": len(user.Chats), "id": user.ID}).Debug("Got list of chats for user")
@@ -0,0 +1,110 @@
+package chats
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+func markRead(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "chats", "remote_address": r.RemoteAddr, "path": "/api/chats/{chat}/read", "method": "POST"})
+
+	// Validate initial request on path parameters, headers and body
+	vars := mux.Vars(r)
+	if _, ok := vars["chat"]; !ok {
+		logger.WithField("chat", vars["chat"]).Trace("Invalid value for path parameter")
+		util.Responses.Error(w, http.StatusBadRequest, "path parameter 'chat' must be present")
+		return
+	} else if r.Header.Get("Content-Type") != "application/json" {
+		logger.WithFields(logrus.Fields{"chat": vars["chat"], "content_type": r.Header.Get("Content-Type")}).Trace("Invalid value for content type header")
+		util.Responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+		return
+	} else if r.Body == nil {
+		logger.WithField("chat", vars["chat"]).Trace("No request body given")
+		util.Responses.Error(w, http.StatusBadRequest, "body must be present")
+		return
+	}
+	logger.WithField("chat", vars["chat"]).Trace("Validated initial request")
+
+	// Add chat id to logger
+	logger = logger.WithField("chat", vars["chat"])
+
+	// Parse JSON body
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.WithError(err).Trace("Invalid json body")
+		util.Responses.Error(w, http.StatusBadRequest, "unable to decode JSON: "+err.Error())
+		return
+	}
+	logger.Trace("Validated JSON body")
+
+	// Ensure chat exists
+	var chat database.Chat
+	db.Preload("Users").Where("uuid = ?", vars["chat"]).First(&chat)
+	if chat.ID == 0 {
+		logger.Trace("Specified chat does not exist")
+		util.Responses.Error(w, http.StatusBadRequest, "specified chat does not exist")
+		return
+	}
+	logger.Trace("Retrieved chat information from database")
+
+	// Get token w/o validation
+	token, err := util.JWT.Unvalidated(r.Header.Get("Authorization"))
+	if err != nil {
+		logger.WithError(err).Error("Unable to get unvalidated token")
+		util.Responses.Error(w, http.StatusInternalServerError, "failed to get token parts")
+		return
+	}
+	logger.Trace("Got unvalidated token parts")
+
+	// Get user id from token
+	id, err := util.JWT.UserId(token)
+	if err != nil {
+		logger.WithError(err).Trace("Failed to get user id from token")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger.WithField("uid", id).Trace("Got user id from token")
+
+	// Ensure user is in chat
+	var user database.User
+	for _, u := range chat.Users {
+		if u.ID == id {
+			user = u
+			break
+		}
+	}
+	if user.ID == 0 {
+		logger.WithField("uid", id).Trace("User associated with token not in chat")
+		util.Responses.Error(w, http.StatusForbidden, "user is not part of specified chat")
+		return
+	}
+	logger.WithField("uid", id).Trace("Confirmed requesting user in chat")
+
+	// Get the message to read up to, defaulting to the latest
+	var message database.Message
+	if body.Message != "" {
+		db.Where("chat_id = ? AND uuid = ?", chat.ID, body.Message).First(&message)
+	} else {
+		db.Where("chat_id = ?", chat.ID).Order("id desc").First(&message)
+	}
+	if message.ID == 0 {
+		logger.WithField("message", body.Message).Trace("Message does not exist in chat")
+		util.Responses.Error(w, http.StatusBadRequest, "specified message does not exist")
+		return
+	}
+	logger.WithField("message", message.UUID).Trace("Retrieved message to read up to")
+
+	// Move read marker and notify members
+	hub.MarkRead(user, chat, message)
+
+	util.Responses.Success(w)
+	logger.Debug("Marked chat as read")
+}
@@ -55,6 +55,8 @@ func read(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	// Check if requesting user is part of chat
 	for _, user := range chat.Users {
 		if id == user.ID {
+			loadRoles(db, &chat)
+			loadReceipts(db, &chat)
 			util.Responses.SuccessWithData(w, chat)
 			logger.Debug("Retrieve chat from database")
 			return
@@ -0,0 +1,54 @@
+package chats
+
+import (
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/jinzhu/gorm"
+)
+
+// Unread and mention counts of a user in a chat
+type unreadCount struct {
+	ChatId   uint
+	Unread   int
+	Mentions int
+}
+
+// Fill in the last message read by each user in a chat
+func loadReceipts(db *gorm.DB, chat *database.Chat) {
+	var receipts []struct {
+		Username string
+		UUID     string
+	}
+	db.Table("user_chats").Select("users.username, messages.uuid").
+		Joins("JOIN users ON users.id = user_chats.user_id").
+		Joins("JOIN messages ON messages.id = user_chats.last_read_id").
+		Where("user_chats.chat_id = ?", chat.ID).Scan(&receipts)
+
+	chat.Read = make(map[string]string)
+	for _, receipt := range receipts {
+		chat.Read[receipt.Username] = receipt.UUID
+	}
+}
+
+// Count the messages from others in each of a user's chats since they last read it,
+// and how many of those mention the user by username
+//
+// A mention must be followed by the end of the message or a character that cannot be part of a
+// username, so @bob does not count as a mention of bo, and the username is escaped to be matched literally
+func countUnread(db *gorm.DB, userId uint) map[uint]unreadCount {
+	var counts []unreadCount
+	db.Raw(`SELECT user_chats.chat_id,
+		COUNT(messages.id) AS unread,
+		COUNT(messages.id) FILTER (WHERE messages.message ~ ('@' || regexp_replace(users.username, '[^[:alnum:]_]', '\\\&', 'g') || '([^[:alnum:]_]|$)')) AS mentions
+	FROM user_chats
+	JOIN users ON users.id = user_chats.user_id
+	LEFT JOIN messages ON messages.chat_id = user_chats.chat_id AND messages.id > user_chats.last_read_id
+		AND messages.sender_id <> user_chats.user_id AND messages.deleted_at IS NULL
+	WHERE user_chats.user_id = ?
+	GROUP BY user_chats.chat_id`, userId).Scan(&counts)
+
+	byChat := make(map[uint]unreadCount)
+	for _, count := range counts {
+		byChat[count.ChatId] = count
+	}
+	return byChat
+}
@@ -0,0 +1,46 @@
+package chats
+
+import (
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/jinzhu/gorm"
+)
+
+// Get the role of a user in a chat, empty if they are not a member
+func memberRole(db *gorm.DB, chatId, userId uint) string {
+	var membership database.UserChat
+	db.Where("chat_id = ? AND user_id = ?", chatId, userId).First(&membership)
+	return membership.Role
+}
+
+// Set the role of a member of a chat
+func setMemberRole(db *gorm.DB, chatId, userId uint, role string) {
+	db.Model(&database.UserChat{}).Where("chat_id = ? AND user_id = ?", chatId, userId).Update("role", role)
+}
+
+// Fill in the role of each user in a chat
+func loadRoles(db *gorm.DB, chat *database.Chat) {
+	var memberships []database.UserChat
+	db.Where("chat_id = ?", chat.ID).Find(&memberships)
+
+	chat.Roles = make(map[string]string)
+	for _, membership := range memberships {
+		for _, user := range chat.Users {
+			if user.ID == membership.UserId {
+				chat.Roles[user.Username] = membership.Role
+				break
+			}
+		}
+	}
+}
+
+// Make the earliest registered admin of a chat its owner, or member if there are no admins
+func promoteSuccessor(db *gorm.DB, chatId uint) uint {
+	var successor database.UserChat
+	db.Where("chat_id = ? AND role = ?", chatId, database.ChatAdmin).Order("user_id").First(&successor)
+	if successor.UserId == 0 {
+		db.Where("chat_id = ?", chatId).Order("user_id").First(&successor)
+	}
+
+	setMemberRole(db, chatId, successor.UserId, database.ChatOwner)
+	return successor.UserId
+}
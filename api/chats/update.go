@@ -4,13 +4,14 @@ import (
 	"encoding/json"
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 	"net/http"
 )
 
-func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+func update(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gorm.DB) {
 	logger := logrus.WithFields(logrus.Fields{"app": "chats", "remote_address": r.RemoteAddr, "path": "/api/chats/{chat}", "method": "PUT"})
 
 	// Validate initial request on path parameters, headers, and body
@@ -62,25 +63,24 @@ func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	logger.WithField("uid", uid).Trace("Got user id from token")
 
 	// Check if requesting user is part of chat
-	valid := false
-	for _, user := range chat.Users {
-		if uid == user.ID {
-			valid = true
-			break
-		}
-	}
-	if !valid {
+	role := memberRole(db, chat.ID, uid)
+	if role == "" {
 		logger.WithField("uid", uid).Trace("User associated with token not in chat")
 		util.Responses.Error(w, http.StatusForbidden, "user is not part of specified chat")
 		return
+	} else if role != database.ChatOwner && role != database.ChatAdmin {
+		logger.WithFields(logrus.Fields{"uid": uid, "role": role}).Trace("User associated with token cannot modify chat")
+		util.Responses.Error(w, http.StatusForbidden, "only chat owners and admins can modify the chat")
+		return
 	}
-	logger.WithField("uid", uid).Trace("Confirmed requesting user in chat")
+	logger.WithFields(logrus.Fields{"uid": uid, "role": role}).Trace("Confirmed requesting user can modify chat")
 
 	// Parse JSON body
 	var body struct {
 		Name string `json:"name"`
 		Mode string `json:"mode"`
 		User string `json:"user"`
+		Role string `json:"role"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		logger.WithError(err).Trace("Invalid json body")
@@ -90,11 +90,17 @@ func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 		logger.WithFields(logrus.Fields{"mode": body.Mode, "user": body.User}).Trace("Field user and mode must be passed together")
 		util.Responses.Error(w, http.StatusBadRequest, "field 'user' must be passed when field 'mode' is present")
 		return
+	} else if body.Mode == "role" && body.Role != database.ChatAdmin && body.Role != database.ChatMember {
+		logger.WithField("role", body.Role).Trace("Invalid role, must be admin/member")
+		util.Responses.Error(w, http.StatusBadRequest, "field 'role' must be one of 'admin', 'member'")
+		return
 	}
 
 	// Modify name if passed
+	settingsChanged := false
 	if body.Name != "" {
 		chat.DisplayName = body.Name
+		settingsChanged = true
 		logger.Trace("Set new display name for chat")
 	}
 
@@ -127,29 +133,71 @@ func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 			db.Model(&user).Association("Chats").Append(&chat)
 			logger.WithField("user", body.User).Trace("Associated user with chat and chat with user")
 
+			// Notify members, including the new user, of the addition
+			hub.PushChatEvent(chat.Users, websockets.EventChatMemberAdded, chat.UUID, websockets.MemberEvent{User: user.Username, Role: database.ChatMember})
+
 		// Remove user from chat
 		case "delete":
 			// Ensure user is in chat
-			valid := false
-			for _, c := range user.Chats {
-				if c.ID == chat.ID {
-					valid = true
-					break
-				}
-			}
-			if !valid {
+			targetRole := memberRole(db, chat.ID, user.ID)
+			if targetRole == "" {
 				logger.WithField("user", body.User).Trace("Specified user not in chat")
 				util.Responses.Error(w, http.StatusBadRequest, "specified user is not in chat")
 				return
 			}
 
+			// Ensure the user is not above the requesting user
+			if targetRole == database.ChatOwner {
+				logger.WithField("user", body.User).Trace("Cannot remove chat owner")
+				util.Responses.Error(w, http.StatusForbidden, "chat owner cannot be removed, transfer ownership first")
+				return
+			} else if targetRole == database.ChatAdmin && role != database.ChatOwner {
+				logger.WithField("user", body.User).Trace("Only owner can remove chat admins")
+				util.Responses.Error(w, http.StatusForbidden, "only the chat owner can remove admins")
+				return
+			}
+
 			db.Model(&chat).Association("Users").Delete(&user)
 			db.Model(&user).Association("Chats").Delete(&chat)
 			logger.WithField("user", body.User).Trace("Removed associated between user and chat")
 
+			// Notify members, including the removed user, of the removal
+			hub.PushChatEvent(append(chat.Users, user), websockets.EventChatMemberRemoved, chat.UUID, websockets.MemberEvent{User: user.Username, Reason: websockets.RemovedByUser})
+
+		// Change the role of a member of the chat
+		case "role", "transfer":
+			// Ensure requesting user is the owner
+			if role != database.ChatOwner {
+				logger.WithField("mode", body.Mode).Trace("Only owner can change roles")
+				util.Responses.Error(w, http.StatusForbidden, "only the chat owner can change roles")
+				return
+			} else if user.ID == uid {
+				logger.WithField("mode", body.Mode).Trace("Owner cannot change own role")
+				util.Responses.Error(w, http.StatusBadRequest, "cannot change own role")
+				return
+			}
+
+			// Ensure user is in chat
+			if memberRole(db, chat.ID, user.ID) == "" {
+				logger.WithField("user", body.User).Trace("Specified user not in chat")
+				util.Responses.Error(w, http.StatusBadRequest, "specified user is not in chat")
+				return
+			}
+
+			// Hand over ownership, keeping the previous owner as an admin
+			if body.Mode == "transfer" {
+				setMemberRole(db, chat.ID, user.ID, database.ChatOwner)
+				setMemberRole(db, chat.ID, uid, database.ChatAdmin)
+				logger.WithField("user", body.User).Trace("Transferred chat ownership to user")
+			} else {
+				setMemberRole(db, chat.ID, user.ID, body.Role)
+				logger.WithFields(logrus.Fields{"user": body.User, "role": body.Role}).Trace("Changed role of user in chat")
+			}
+			settingsChanged = true
+
 		default:
-			logger.WithField("mode", body.Mode).Trace("Invalid mode, must be add/delete")
-			util.Responses.Error(w, http.StatusBadRequest, "field 'mode' must be one of 'add', 'delete'")
+			logger.WithField("mode", body.Mode).Trace("Invalid mode, must be add/delete/role/transfer")
+			util.Responses.Error(w, http.StatusBadRequest, "field 'mode' must be one of 'add', 'delete', 'role', 'transfer'")
 			return
 		}
 	}
@@ -158,6 +206,12 @@ func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	db.Save(&chat)
 	logger.Trace("Saved updates to chat")
 
+	// Notify members of the new name or roles
+	if settingsChanged {
+		loadRoles(db, &chat)
+		hub.PushChatEvent(chat.Users, websockets.EventChatUpdated, chat.UUID, chat)
+	}
+
 	util.Responses.Success(w)
 	logger.Debug("Updated chat with specified data")
 }
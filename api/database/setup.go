@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"reflect"
@@ -11,19 +12,27 @@ import (
 
 var logger = logrus.WithField("app", "database")
 
+// Get the connection parameters for the database from the configuration
+func ConnectionString() string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s", viper.GetString("database.host"), viper.GetString("database.port"), viper.GetString("database.username"), viper.GetString("database.password"), viper.GetString("database.database"), viper.GetString("database.ssl"))
+}
+
 // Connect to the database and create the schema
 func SetupDatabase() *gorm.DB {
 	logger.WithFields(logrus.Fields{"host": viper.GetString("database.host"), "port": viper.GetInt("database.port"), "ssl": viper.GetString("database.ssl")}).Info("Connecting to database...")
 	// Connect to database
-	db, err := gorm.Open("postgres", fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s", viper.GetString("database.host"), viper.GetString("database.port"), viper.GetString("database.username"), viper.GetString("database.password"), viper.GetString("database.database"), viper.GetString("database.ssl")))
+	db, err := gorm.Open("postgres", ConnectionString())
 	if err != nil {
 		logger.WithError(err).Fatal("Failed to connect to database")
 	}
 	logger.Info("Successfully connected to database")
 
+	// Read markers are added to existing memberships below
+	addReadMarkers := !viper.GetBool("database.reset") && db.HasTable(&UserChat{}) && !db.Dialect().HasColumn("user_chats", "last_read_id")
+
 	logger.Info("Building database schema if nonexistent...")
 	// Create schema if not exist
-	for _, model := range []interface{}{&User{}, &Token{}, &Chat{}, &Message{}, &File{}} {
+	for _, model := range []interface{}{&User{}, &Token{}, &SigningKey{}, &RevokedToken{}, &Session{}, &RecoveryCode{}, &Throttle{}, &OIDCState{}, &OIDCIdentity{}, &Chat{}, &UserChat{}, &Message{}, &MessageRevision{}, &File{}, &Event{}, &EventSequence{}, &Connection{}} {
 		if viper.GetBool("database.reset") {
 			db.DropTableIfExists(model)
 			db.CreateTable(model)
@@ -31,13 +40,69 @@ func SetupDatabase() *gorm.DB {
 		} else if !db.HasTable(model) {
 			db.CreateTable(model)
 			logger.WithField("model", reflect.TypeOf(model).Name()).Trace("Created model in database")
+		} else {
+			db.AutoMigrate(model)
+			logger.WithField("model", reflect.TypeOf(model).Name()).Trace("Migrated model to add any new columns")
 		}
 	}
 	logger.Info("Successfully built database schema if nonexistent")
 
+	// Give chats created before membership roles an owner
+	assignChatOwners(db)
+
+	// Give messages created before they were addressed by uuid one
+	assignMessageUUIDs(db)
+
+	// Start read markers at the latest message so existing chats are not all unread
+	if addReadMarkers {
+		markChatsRead(db)
+	}
+
 	// Enable struct preloading (for relationships)
 	db.Set("gorm:auto_preload", true)
 	logger.Trace("Enable automatically preloading table relationships")
 
 	return db
 }
+
+// Make the member who sent the first message the owner of any chat without one,
+// falling back to the longest registered member if they have left
+func assignChatOwners(db *gorm.DB) {
+	owned := db.Table("user_chats").Select("chat_id").Where("role = ?", ChatOwner).QueryExpr()
+
+	creators := db.Exec(`UPDATE user_chats SET role = ? FROM (
+		SELECT DISTINCT ON (chat_id) chat_id, sender_id FROM messages WHERE deleted_at IS NULL ORDER BY chat_id, id
+	) AS first WHERE user_chats.chat_id = first.chat_id AND user_chats.user_id = first.sender_id AND user_chats.chat_id NOT IN (?)`, ChatOwner, owned)
+	remaining := db.Exec(`UPDATE user_chats SET role = ? FROM (
+		SELECT chat_id, MIN(user_id) AS user_id FROM user_chats GROUP BY chat_id
+	) AS first WHERE user_chats.chat_id = first.chat_id AND user_chats.user_id = first.user_id AND user_chats.chat_id NOT IN (?)`, ChatOwner, owned)
+
+	if count := creators.RowsAffected + remaining.RowsAffected; count > 0 {
+		logger.WithField("count", count).Info("Assigned owners to chats without one")
+	}
+}
+
+// Generate a uuid for every message without one
+func assignMessageUUIDs(db *gorm.DB) {
+	var messages []Message
+	db.Unscoped().Where("uuid IS NULL OR uuid = ''").Find(&messages)
+
+	for _, message := range messages {
+		db.Unscoped().Model(&message).UpdateColumn("uuid", uuid.NewV4().String())
+	}
+
+	if len(messages) > 0 {
+		logger.WithField("count", len(messages)).Info("Assigned uuids to messages without one")
+	}
+}
+
+// Mark every chat as read up to its latest message for all of its members
+func markChatsRead(db *gorm.DB) {
+	result := db.Exec(`UPDATE user_chats SET last_read_id = latest.id FROM (
+		SELECT chat_id, MAX(id) AS id FROM messages GROUP BY chat_id
+	) AS latest WHERE user_chats.chat_id = latest.chat_id`)
+
+	if result.RowsAffected > 0 {
+		logger.WithField("count", result.RowsAffected).Info("Marked existing chats as read")
+	}
+}
@@ -1,19 +1,59 @@
 package database
 
-import "github.com/jinzhu/gorm"
+import (
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
 
 const (
 	MessageNormal = iota
 	MessageImage
 	MessageFile
+	MessageSystem
 )
 
 const (
 	TokenAuthentication = iota
 	TokenResetPassword
 	TokenVerification
+	TokenRefresh
+	TokenMFAPending
+	TokenPersonalAccess
+	TokenMagicLink
+	TokenChangeEmail
+)
+
+// Where a user's credentials are checked
+const (
+	SourceLocal = "local"
+	SourceLDAP  = "ldap"
+)
+
+// Roles a user can have, each including the permissions of the ones before it
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
 )
 
+var roleLevels = map[string]int{RoleUser: 0, RoleModerator: 1, RoleAdmin: 2}
+
+// Statuses a user can set, shown instead of online while they are connected
+const (
+	StatusNone         = ""
+	StatusAway         = "away"
+	StatusDoNotDisturb = "dnd"
+)
+
+// Scopes that can be granted to personal access tokens
+var TokenScopes = []string{
+	"chats:read", "chats:write",
+	"messages:read", "messages:write",
+	"files:read", "files:write",
+	"users:read", "users:write",
+}
+
 // Store user login information
 type User struct {
 	gorm.Model `json:"-"`
@@ -23,6 +63,42 @@ type User struct {
 	Password   string `json:"-"`
 	Chats      []Chat `json:"-" gorm:"many2many:user_chats"`
 	Verified   bool   `json:"verified"`
+	Source     string `json:"-" gorm:"default:'local'"`
+
+	// New email waiting to be confirmed
+	PendingEmail string `json:"-"`
+
+	// Server-wide permissions
+	Role     string `json:"role" gorm:"default:'user'"`
+	Disabled bool   `json:"-"`
+
+	// Two-factor authentication
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool   `json:"-"`
+	TOTPLastStep int64  `json:"-"`
+
+	// Presence, which is only set when reading a specific user
+	Presence   string `json:"presence,omitempty" gorm:"-"`
+	Status     string `json:"status"`
+	StatusText string `json:"status_text"`
+	LastSeen   int64  `json:"last_seen"`
+}
+
+// Check if a user has at least the permissions of a role
+func (u User) HasRole(role string) bool {
+	level, ok := roleLevels[u.Role]
+	return ok && level >= roleLevels[role]
+}
+
+// Check if a role exists
+func ValidRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
+// Check if a status can be set by a user
+func ValidStatus(status string) bool {
+	return status == StatusNone || status == StatusAway || status == StatusDoNotDisturb
 }
 
 // Store authentication tokens returned from login
@@ -32,8 +108,101 @@ type Token struct {
 	Type       uint
 	UserId     uint
 	User       User
+	Family     string `gorm:"index"`
+	Used       bool
+
+	// Personal access token information
+	Name      string
+	Scopes    string
+	ExpiresAt *time.Time
+
+	// Asymmetric signing key the token was signed with
+	KeyId string `gorm:"index"`
+
+	// Hash of the nonce a magic link is bound to
+	Nonce string
+}
+
+// Check if a token grants the given scope, only personal access tokens are limited
+func (t Token) HasScope(scope string) bool {
+	if t.Type != TokenPersonalAccess {
+		return true
+	}
+
+	for _, s := range strings.Fields(t.Scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Stores asymmetric keys used to sign tokens, rotated periodically
+type SigningKey struct {
+	gorm.Model
+	KeyId      string `gorm:"unique_index"`
+	Algorithm  string
+	PrivateKey string
+	PublicKey  string
+}
+
+// Stores revoked tokens so they are rejected even though their signature is valid
+type RevokedToken struct {
+	gorm.Model
+	TokenId   string `gorm:"unique_index"`
+	ExpiresAt *time.Time
+}
+
+// Stores in progress OpenID Connect logins between the redirect and callback
+type OIDCState struct {
+	gorm.Model
+	State    string `gorm:"unique_index"`
+	Provider string
+	Verifier string
+	Nonce    string
 }
 
+// Links a user to their account at an OpenID Connect provider
+type OIDCIdentity struct {
+	gorm.Model
+	Provider string `gorm:"unique_index:idx_oidc_provider_subject"`
+	Subject  string `gorm:"unique_index:idx_oidc_provider_subject"`
+	UserId   uint   `gorm:"index"`
+}
+
+// Stores failed attempts for brute-force protection by key, such as a username or IP address
+type Throttle struct {
+	gorm.Model
+	Key         string `gorm:"unique_index"`
+	Attempts    uint
+	LastAttempt time.Time
+	LockedUntil time.Time
+}
+
+// Stores hashed one-time recovery codes for two-factor authentication
+type RecoveryCode struct {
+	gorm.Model
+	UserId uint `gorm:"index"`
+	Code   string
+}
+
+// Stores login session information shared by a family of tokens
+type Session struct {
+	gorm.Model
+	UUID      string `gorm:"unique_index"`
+	UserId    uint
+	UserAgent string
+	IPAddress string
+	LastUsed  time.Time
+}
+
+// Roles a user can have in a chat
+const (
+	ChatOwner  = "owner"
+	ChatAdmin  = "admin"
+	ChatMember = "member"
+)
+
 // Stores user chat information
 type Chat struct {
 	gorm.Model  `json:"-"`
@@ -41,11 +210,37 @@ type Chat struct {
 	UUID        string    `json:"uuid"`
 	Users       []User    `json:"users" gorm:"many2many:user_chats"`
 	Messages    []Message `json:"messages" gorm:"foreignkey:ChatId"`
+
+	// Role of each user by username, filled in when sent to clients
+	Roles map[string]string `json:"roles,omitempty" gorm:"-"`
+
+	// Last message read by each user by username, filled in when reading a specific chat
+	Read map[string]string `json:"read,omitempty" gorm:"-"`
+
+	// Messages from others since the requesting user last read the chat, filled in when listing chats
+	Unread   int `json:"unread" gorm:"-"`
+	Mentions int `json:"mentions" gorm:"-"`
+}
+
+// Stores the membership of a user in a chat, sharing the join table of the chat's users
+type UserChat struct {
+	UserId uint   `gorm:"primary_key;auto_increment:false"`
+	ChatId uint   `gorm:"primary_key;auto_increment:false"`
+	Role   string `gorm:"default:'member'"`
+
+	// Last message the user has read in the chat
+	LastReadId uint  `gorm:"default:0"`
+	LastReadAt int64 `gorm:"default:0"`
+}
+
+func (UserChat) TableName() string {
+	return "user_chats"
 }
 
 // Stores user message information
 type Message struct {
 	gorm.Model `json:"-"`
+	UUID       string `json:"uuid" gorm:"unique_index"`
 	ChatId     uint   `json:"-"`
 	SenderId   uint   `json:"-"`
 	Sender     User   `json:"sender" gorm:"foreignkey:SenderId"`
@@ -54,6 +249,52 @@ type Message struct {
 	File       *File  `json:"file" gorm:"foreignkey:FileId"`
 	FileId     uint   `json:"-"`
 	Timestamp  int64  `json:"timestamp"`
+
+	// When the message was last edited in nanoseconds since the Unix epoch, zero if never edited
+	EditedAt int64 `json:"edited_at"`
+
+	// User that deleted the message, either the sender or a chat admin or moderator
+	DeletedById uint `json:"-"`
+}
+
+// Stores a previous version of an edited message
+type MessageRevision struct {
+	gorm.Model `json:"-"`
+	MessageId  uint   `json:"-" gorm:"index"`
+	Message    string `json:"message"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// Stores events pushed to a user so they can be replayed when a websocket reconnects
+type Event struct {
+	gorm.Model
+	UserId uint   `gorm:"unique_index:idx_event_user_seq"`
+	Seq    uint64 `gorm:"unique_index:idx_event_user_seq"`
+	Event  string
+	Chat   string
+	Data   string
+}
+
+// Stores the last event sequence number given to each user
+type EventSequence struct {
+	UserId uint `gorm:"primary_key;auto_increment:false"`
+	Seq    uint64
+}
+
+// Stores the live websocket connections on every instance for presence and administration
+type Connection struct {
+	Id          string `gorm:"primary_key"`
+	UserId      uint   `gorm:"index"`
+	HeartbeatAt int64
+
+	// Where the connection came from, and the instance it is connected to
+	Instance      string
+	Session       string
+	Device        string
+	UserAgent     string
+	RemoteAddress string
+	ForwardedFor  string
+	ConnectedAt   time.Time
 }
 
 // Stores file information related to messages
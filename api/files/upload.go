@@ -168,7 +168,7 @@ func post(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gorm.
 		}
 
 		// Send message
-		hub.PushMessage(user.Username, message, chat.UUID)
+		hub.PushMessage(user, message, chat.UUID)
 	}
 
 	util.Responses.Success(w)
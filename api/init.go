@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/akrantz01/apcsp/api/util"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"os"
@@ -43,6 +44,29 @@ func init() {
 	viper.SetDefault("database.database", "postgres")
 	viper.SetDefault("database.ssl", "disable")
 	viper.SetDefault("database.reset", false)
+	viper.SetDefault("auth.backend", "local")
+	viper.SetDefault("ldap.url", "ldap://127.0.0.1:389")
+	viper.SetDefault("ldap.start_tls", true)
+	viper.SetDefault("ldap.bind_dn", "")
+	viper.SetDefault("ldap.bind_password", "")
+	viper.SetDefault("ldap.base_dn", "")
+	viper.SetDefault("ldap.user_filter", "(uid=%s)")
+	viper.SetDefault("ldap.name_attribute", "cn")
+	viper.SetDefault("ldap.email_attribute", "mail")
+	viper.SetDefault("ldap.required_group", "")
+	viper.SetDefault("ldap.group_attribute", "member")
+	viper.SetDefault("admin.username", "")
+	viper.SetDefault("admin.email", "")
+	viper.SetDefault("admin.password", "")
+	viper.SetDefault("jwt.mode", "hmac")
+	viper.SetDefault("jwt.rotation", 604800)
+	viper.SetDefault("oidc.redirect", "")
+	viper.SetDefault("security.backoff_after", 3)
+	viper.SetDefault("security.lockout_attempts", 10)
+	viper.SetDefault("security.address_lockout_attempts", 50)
+	viper.SetDefault("security.lockout_duration", 900)
+	viper.SetDefault("websockets.broker", "local")
+	viper.SetDefault("websockets.channel", "chat_events")
 	logrus.WithField("app", "initialization").Trace("Set defaults for configuration keys")
 
 	// Allow loading config from environment variables
@@ -67,6 +91,30 @@ func init() {
 	}
 	logrus.WithField("app", "initialization").Trace("Validated database ssl connection mode")
 
+	// Validate authentication backend
+	if backend := viper.GetString("auth.backend"); backend != "local" && backend != "ldap" && backend != "both" {
+		logrus.WithFields(logrus.Fields{"app": "initialization", "key": "auth.backend", "value": backend, "options": []string{"local", "ldap", "both"}}).Fatal("Invalid value for authentication backend")
+	}
+	logrus.WithField("app", "initialization").Trace("Validated authentication backend")
+
+	// Ensure directory connections are encrypted
+	if viper.GetString("auth.backend") != "local" && !util.LDAP.Secure() {
+		logrus.WithFields(logrus.Fields{"app": "initialization", "key": "ldap.start_tls", "url": viper.GetString("ldap.url")}).Fatal("LDAP connection must use ldaps:// or StartTLS")
+	}
+	logrus.WithField("app", "initialization").Trace("Validated directory connection security")
+
+	// Validate websocket event broker
+	if broker := viper.GetString("websockets.broker"); broker != "local" && broker != "postgres" {
+		logrus.WithFields(logrus.Fields{"app": "initialization", "key": "websockets.broker", "value": broker, "options": []string{"local", "postgres"}}).Fatal("Invalid value for websocket event broker")
+	}
+	logrus.WithField("app", "initialization").Trace("Validated websocket event broker")
+
+	// Validate token signing mode
+	if mode := viper.GetString("jwt.mode"); mode != "hmac" && mode != "rs256" && mode != "eddsa" {
+		logrus.WithFields(logrus.Fields{"app": "initialization", "key": "jwt.mode", "value": mode, "options": []string{"hmac", "rs256", "eddsa"}}).Fatal("Invalid value for token signing mode")
+	}
+	logrus.WithField("app", "initialization").Trace("Validated token signing mode")
+
 	// Delete all uploaded files
 	if viper.GetBool("http.reset_files") {
 		if err := os.RemoveAll("./uploaded"); err != nil {
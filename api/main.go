@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"flag"
+	"github.com/akrantz01/apcsp/api/admin"
 	"github.com/akrantz01/apcsp/api/authentication"
 	"github.com/akrantz01/apcsp/api/chats"
 	"github.com/akrantz01/apcsp/api/database"
@@ -30,17 +32,54 @@ import (
 var shutdown = make(chan os.Signal, 1)
 var mail = make(chan *gomail.Message)
 
+// Command line flags
+var unlock = flag.String("unlock", "", "Remove lockouts and failed login attempts for a username, then exit")
+var promote = flag.String("promote", "", "Give a username the administrator role, then exit")
+
 func main() {
 	logger := logrus.WithField("app", "main")
 
+	// Parse command line flags
+	flag.Parse()
+
 	// Initialize file embedding
 	box := packr.New("static", "./static")
 
 	// Connect to the database
 	db := database.SetupDatabase()
 
-	// Create websocket hub
-	hub := websockets.NewHub()
+	// Unlock an account and exit if requested
+	if *unlock != "" {
+		if authentication.Unlock(db, *unlock) {
+			logger.WithField("username", *unlock).Info("Unlocked account")
+		} else {
+			logger.WithField("username", *unlock).Info("Account was not locked")
+		}
+		return
+	}
+
+	// Promote a user to administrator and exit if requested
+	if *promote != "" {
+		if admin.Promote(db, *promote) {
+			logger.WithField("username", *promote).Info("Promoted user to administrator")
+		} else {
+			logger.WithField("username", *promote).Error("User does not exist")
+		}
+		return
+	}
+
+	// Create the first administrator if configured
+	admin.Bootstrap(db)
+
+	// Create websocket hub, the broker was already validated during initialization
+	var broker websockets.Broker
+	switch viper.GetString("websockets.broker") {
+	case "postgres":
+		broker = websockets.NewPostgresBroker(db, database.ConnectionString(), viper.GetString("websockets.channel"))
+	default:
+		broker = websockets.NewLocalBroker()
+	}
+	hub := websockets.NewHub(db, broker)
 	logger.Trace("Created websocket hub for connection management")
 
 	// Setup routes
@@ -56,59 +95,68 @@ func main() {
 	logger.Trace("Initialized API subrouter")
 
 	// Authentication routes
-	api.HandleFunc("/auth/login", authentication.Login(db))
+	api.HandleFunc("/auth/login", authentication.Login(db, mail, box))
+	api.HandleFunc("/auth/login/mfa", authentication.LoginMFA(db, mail, box))
+	api.HandleFunc("/auth/mfa", authentication.MFA(db))
+	api.HandleFunc("/auth/mfa/confirm", authentication.ConfirmMFA(db))
 	api.HandleFunc("/auth/logout", authentication.Logout(db))
+	api.HandleFunc("/auth/refresh", authentication.Refresh(db))
+	api.HandleFunc("/auth/sessions", authentication.Sessions(hub, db))
+	api.HandleFunc("/auth/sessions/{session}", authentication.SpecificSession(hub, db))
+	api.HandleFunc("/auth/tokens", authentication.AccessTokens(db))
+	api.HandleFunc("/auth/tokens/{token}", authentication.SpecificAccessToken(db))
+	api.HandleFunc("/auth/oidc/{provider}", authentication.OIDC(db))
+	api.HandleFunc("/auth/oidc/{provider}/callback", authentication.OIDCCallback(db))
 	api.HandleFunc("/auth/forgot-password", authentication.ForgotPassword(db, mail, box))
 	api.HandleFunc("/auth/reset-password", authentication.ResetPassword(db, mail, box))
 	api.HandleFunc("/auth/verify-email", authentication.VerifyEmail(db))
+	api.HandleFunc("/auth/verify-email/resend", authentication.ResendVerification(db, mail, box))
+	api.HandleFunc("/auth/magic-link", authentication.MagicLink(db, mail, box))
+	api.HandleFunc("/auth/magic-link/verify", authentication.VerifyMagicLink(db))
 	logger.Trace("Add authentication routes")
 
 	// User routes
 	api.HandleFunc("/users", users.AllUsers(db, mail, box))
-	api.HandleFunc("/users/{user}", users.SpecificUser(db))
+	api.HandleFunc("/users/{user}", users.SpecificUser(db, hub, mail, box))
 	logger.Trace("Add user management routes")
 
 	// Chat routes
-	api.HandleFunc("/chats", chats.AllChats(db))
-	api.HandleFunc("/chats/{chat}", chats.SpecificChat(db))
+	api.HandleFunc("/chats", chats.AllChats(hub, db))
+	api.HandleFunc("/chats/{chat}", chats.SpecificChat(hub, db))
+	api.HandleFunc("/chats/{chat}/leave", chats.LeaveChat(hub, db))
+	api.HandleFunc("/chats/{chat}/read", chats.MarkRead(hub, db))
 	logger.Trace("Add chat management routes")
 
 	// Messages routes
 	api.HandleFunc("/chats/{chat}/messages", messages.AllMessages(hub, db))
-	api.HandleFunc("/chats/{chat}/messages/{message}", messages.SpecificMessage(db))
+	api.HandleFunc("/chats/{chat}/messages/{message}", messages.SpecificMessage(hub, db))
+	api.HandleFunc("/chats/{chat}/messages/{message}/history", messages.MessageHistory(db))
 	logger.Trace("Add chat message management routes")
 
 	// Files routes
 	api.HandleFunc("/files/{file}", files.Files(hub, db))
 	logger.Trace("Add file management routes")
 
+	// Administration routes
+	api.HandleFunc("/admin/users", admin.AllUsers(db))
+	api.HandleFunc("/admin/users/{user}", admin.SpecificUser(db, hub))
+	api.HandleFunc("/admin/users/{user}/logout", admin.Logout(db, hub))
+	api.HandleFunc("/admin/users/{user}/unlock", admin.Unlock(db))
+	api.HandleFunc("/admin/stats", admin.Stats(db, hub))
+	api.HandleFunc("/admin/connections", admin.Connections(hub))
+	logger.Trace("Add administration routes")
+
 	// Websocket routes
 	api.HandleFunc("/ws", websockets.Websockets(hub, db))
 	logger.Trace("Add websocket routes")
 
-	// Add static HTML routes
-	router.HandleFunc("/reset-password", func(w http.ResponseWriter, r *http.Request) {
-		// Get file from box
-		resetPassword, err := box.Find("reset-password.html")
-		if err != nil {
-			logrus.WithField("app", "static-files").WithError(err).Error("Failed to load file from box")
-			util.Responses.Error(w, http.StatusInternalServerError, "failed to load file from box")
-			return
-		}
-		buffer := bytes.NewBuffer(resetPassword)
-
-		// Write headers
-		w.Header().Set("Content-Type", "text/html")
-		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(resetPassword)), 10))
-		w.WriteHeader(http.StatusOK)
+	// Public key set for verifying tokens
+	router.HandleFunc("/.well-known/jwks.json", authentication.JWKS(db))
+	logger.Trace("Add public key set route")
 
-		// Copy to client
-		if _, err := io.Copy(w, buffer); err != nil {
-			logrus.WithField("app", "static-files").WithError(err).Error("Failed to copy file data to client")
-			util.Responses.Error(w, http.StatusInternalServerError, "failed to copy to client")
-			return
-		}
-	})
+	// Add static HTML routes
+	router.HandleFunc("/reset-password", staticPage(box, "reset-password.html"))
+	router.HandleFunc("/magic-link", staticPage(box, "magic-link.html"))
 
 	// Register router with http and enable cors
 	http.Handle("/", loggingHandler{handler: cors.AllowAll().Handler(router)})
@@ -222,4 +270,35 @@ func main() {
 		logrus.WithError(err).WithField("app", "http-server").Fatal("Failed to shutdown server")
 	}
 	logrus.WithField("app", "http-server").Info("Gracefully shutdown API listener")
+
+	// Stop receiving websocket events from other instances
+	if err := broker.Close(); err != nil {
+		logrus.WithError(err).WithField("app", "websocket").Error("Failed to close websocket event broker")
+	}
+}
+
+// Serve an HTML page from the box
+func staticPage(box *packr.Box, name string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get file from box
+		page, err := box.Find(name)
+		if err != nil {
+			logrus.WithField("app", "static-files").WithError(err).Error("Failed to load file from box")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to load file from box")
+			return
+		}
+		buffer := bytes.NewBuffer(page)
+
+		// Write headers
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(page)), 10))
+		w.WriteHeader(http.StatusOK)
+
+		// Copy to client
+		if _, err := io.Copy(w, buffer); err != nil {
+			logrus.WithField("app", "static-files").WithError(err).Error("Failed to copy file data to client")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to copy to client")
+			return
+		}
+	}
 }
@@ -124,6 +124,7 @@ func create(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gor
 
 		// Save message
 		message := database.Message{
+			UUID:      uuid.NewV4().String(),
 			ChatId:    chat.ID,
 			SenderId:  uid,
 			Type:      0,
@@ -147,10 +148,10 @@ func create(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gor
 			}
 
 			// Send message
-			hub.PushMessage(user.Username, message, vars["chat"])
+			hub.PushMessage(user, message, vars["chat"])
 		}
 
-		util.Responses.Success(w)
+		util.Responses.SuccessWithData(w, map[string]string{"uuid": message.UUID})
 		logger.WithFields(logrus.Fields{"message": message.ID, "sender": message.SenderId}).Debug("Sent given message to chat")
 		return
 	}
@@ -176,6 +177,7 @@ func create(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gor
 
 	// Create message database entry
 	message := database.Message{
+		UUID:      uuid.NewV4().String(),
 		ChatId:    chat.ID,
 		SenderId:  uid,
 		Type:      1,
@@ -199,6 +201,6 @@ func create(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gor
 	db.Model(&chat).Association("Messages").Append(&message)
 	logger.Trace("Associate message with chat")
 
-	util.Responses.SuccessWithData(w, map[string]string{"url": viper.GetString("http.domain") + "/api/files/" + file.UUID})
+	util.Responses.SuccessWithData(w, map[string]string{"uuid": message.UUID, "url": viper.GetString("http.domain") + "/api/files/" + file.UUID})
 	logger.WithFields(logrus.Fields{"message": message.ID, "sender": message.SenderId, "file": file.UUID}).Debug("Created message with file upload link attached")
 }
@@ -3,14 +3,14 @@ package messages
 import (
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 	"net/http"
-	"strconv"
 )
 
-func deleteMethod(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+func deleteMethod(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gorm.DB) {
 	logger := logrus.WithFields(logrus.Fields{"app": "messages", "remote_address": r.RemoteAddr, "path": "/api/chats/{chat}/messages/{message}", "method": "DELETE"})
 
 	// Validate initial request on path parameters
@@ -26,12 +26,12 @@ func deleteMethod(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	}
 	logger.WithFields(logrus.Fields{"chat": vars["chat"], "message": vars["message"]}).Trace("Validated initial request on path parameters")
 
-	// Add chat id and message index to logger
+	// Add chat id and message uuid to logger
 	logger = logger.WithFields(logrus.Fields{"chat": vars["chat"], "message": vars["message"]})
 
 	// Check that chat exists
 	var chat database.Chat
-	db.Preload("Users").Preload("Messages").Where("uuid = ?", vars["chat"]).First(&chat)
+	db.Preload("Users").Where("uuid = ?", vars["chat"]).First(&chat)
 	if chat.ID == 0 {
 		logger.Trace("Specified chat does not exist")
 		util.Responses.Error(w, http.StatusBadRequest, "specified chat does not exist")
@@ -57,41 +57,47 @@ func deleteMethod(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	}
 	logger.WithField("uid", uid).Trace("Got user id from token")
 
-	// Check if requesting user is part of chat
-	valid := false
-	for _, user := range chat.Users {
-		if uid == user.ID {
-			valid = true
-			break
-		}
+	// Get requesting user from database
+	var user database.User
+	db.Where("id = ?", uid).First(&user)
+	if user.ID == 0 {
+		logger.WithField("uid", uid).Trace("User associated with token does not exist")
+		util.Responses.Error(w, http.StatusBadRequest, "specified user does not exist")
+		return
 	}
-	if !valid {
+	logger.WithField("uid", uid).Trace("Retrieved requesting user from database")
+
+	// Check if requesting user is part of chat, moderators can remove messages from any chat
+	var membership database.UserChat
+	db.Where("chat_id = ? AND user_id = ?", chat.ID, uid).First(&membership)
+	if membership.Role == "" && !user.HasRole(database.RoleModerator) {
 		logger.WithField("uid", uid).Trace("User associated with token not in chat")
 		util.Responses.Error(w, http.StatusForbidden, "user is not part of specified chat")
 		return
 	}
-	logger.WithField("uid", uid).Trace("Confirmed requesting user in chat")
+	logger.WithFields(logrus.Fields{"uid": uid, "role": membership.Role}).Trace("Confirmed requesting user can access chat")
 
-	// Convert path parameter to integer
-	index, err := strconv.ParseInt(vars["message"], 10, 64)
-	if err != nil {
-		logger.Trace("Invalid value for message index")
-		util.Responses.Error(w, http.StatusBadRequest, "message index must be an integer")
+	// Get message from chat
+	message, ok := findMessage(w, db, chat, vars["message"], logger)
+	if !ok {
 		return
 	}
-	logger.Trace("Converted message index to integer")
 
-	// Check integer bounds
-	if index > int64(len(chat.Messages)-1) {
-		logger.WithField("total_messages", len(chat.Messages)-1).Trace("Message index greater than total messages")
-		util.Responses.Error(w, http.StatusBadRequest, "message index is out of bounds")
+	// Ensure requesting user sent the message, administers the chat, or is a moderator
+	if message.SenderId != uid && membership.Role != database.ChatOwner && membership.Role != database.ChatAdmin && !user.HasRole(database.RoleModerator) {
+		logger.WithFields(logrus.Fields{"uid": uid, "sender": message.SenderId}).Trace("User cannot delete message sent by another user")
+		util.Responses.Error(w, http.StatusForbidden, "only the sender or a chat admin can delete the message")
 		return
 	}
-	logger.Trace("Validated message index not out of bounds")
 
-	// Delete specified message
-	db.Delete(&chat.Messages[index])
+	// Record who removed the message and delete it
+	db.Model(&message).UpdateColumn("deleted_by_id", uid)
+	db.Delete(&message)
+	logger.WithField("deleted_by", user.Username).Trace("Deleted message")
+
+	// Notify members of the deletion
+	hub.PushChatEvent(chat.Users, websockets.EventMessageDeleted, chat.UUID, websockets.DeletedEvent{UUID: message.UUID, DeletedBy: user.Username})
 
-	util.Responses.Success(w)
-	logger.Debug("Delete message at specified index")
+	util.Responses.SuccessWithData(w, map[string]string{"uuid": message.UUID, "deleted_by": user.Username})
+	logger.Debug("Deleted specified message")
 }
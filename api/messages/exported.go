@@ -24,17 +24,30 @@ func AllMessages(hub *websockets.Hub, db *gorm.DB) func(w http.ResponseWriter, r
 }
 
 // Methods pertaining to a specific message such as description, deletion, and updating
-func SpecificMessage(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+func SpecificMessage(hub *websockets.Hub, db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			read(w, r, db)
 
 		case http.MethodPut:
-			update(w, r, db)
+			update(w, r, hub, db)
 
 		case http.MethodDelete:
-			deleteMethod(w, r, db)
+			deleteMethod(w, r, hub, db)
+
+		default:
+			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Previous versions of an edited message
+func MessageHistory(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			history(w, r, db)
 
 		default:
 			util.Responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
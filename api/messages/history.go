@@ -0,0 +1,105 @@
+package messages
+
+import (
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+func history(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	logger := logrus.WithFields(logrus.Fields{"app": "messages", "remote_address": r.RemoteAddr, "path": "/api/chats/{chat}/messages/{message}/history", "method": "GET"})
+
+	// Validate initial request on path parameters
+	vars := mux.Vars(r)
+	if _, ok := vars["chat"]; !ok {
+		logger.WithField("chat", vars["chat"]).Trace("Invalid value for chat path parameter")
+		util.Responses.Error(w, http.StatusBadRequest, "path parameter 'chat' must be present")
+		return
+	} else if _, ok := vars["message"]; !ok {
+		logger.WithFields(logrus.Fields{"chat": vars["chat"], "message": vars["message"]}).Trace("Invalid value for message path parameter")
+		util.Responses.Error(w, http.StatusBadRequest, "path parameter 'message' must be present")
+		return
+	}
+	logger.WithFields(logrus.Fields{"chat": vars["chat"], "message": vars["message"]}).Trace("Validated initial request on path parameters")
+
+	// Add chat id and message uuid to logger
+	logger = logger.WithFields(logrus.Fields{"chat": vars["chat"], "message": vars["message"]})
+
+	// Check if chat exists
+	var chat database.Chat
+	db.Preload("Users").Where("uuid = ?", vars["chat"]).First(&chat)
+	if chat.ID == 0 {
+		logger.Trace("Chat does not exist")
+		util.Responses.Error(w, http.StatusBadRequest, "specified chat does not exist")
+		return
+	}
+	logger.Trace("Retrieved chat from database")
+
+	// Get token w/o validation
+	token, err := util.JWT.Unvalidated(r.Header.Get("Authorization"))
+	if err != nil {
+		logger.WithError(err).Error("Unable to get unvalidated token")
+		util.Responses.Error(w, http.StatusInternalServerError, "failed to get token parts")
+		return
+	}
+	logger.Trace("Got unvalidated token parts")
+
+	// Get user id from token
+	uid, err := util.JWT.UserId(token)
+	if err != nil {
+		logger.WithError(err).Trace("Failed to get user id from token")
+		util.Responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger.WithField("uid", uid).Trace("Got user id from token")
+
+	// Get requesting user from database
+	var user database.User
+	db.Where("id = ?", uid).First(&user)
+	if user.ID == 0 {
+		logger.WithField("uid", uid).Trace("User associated with token does not exist")
+		util.Responses.Error(w, http.StatusBadRequest, "specified user does not exist")
+		return
+	}
+	logger.WithField("uid", uid).Trace("Retrieved requesting user from database")
+
+	// Ensure user is a part of chat, moderators can review messages from any chat
+	valid := user.HasRole(database.RoleModerator)
+	for _, u := range chat.Users {
+		if uid == u.ID {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		logger.WithField("uid", uid).Trace("User associated with token not in chat")
+		util.Responses.Error(w, http.StatusForbidden, "specified user is not part of chat")
+		return
+	}
+	logger.WithField("uid", uid).Trace("Confirmed requesting user can access chat")
+
+	// Get message from chat, moderators can also review deleted messages
+	lookup := db
+	if user.HasRole(database.RoleModerator) {
+		lookup = db.Unscoped()
+	}
+	message, ok := findMessage(w, lookup, chat, vars["message"], logger)
+	if !ok {
+		return
+	}
+
+	// Get previous versions, oldest first
+	revisions := []database.MessageRevision{}
+	db.Where("message_id = ?", message.ID).Order("id").Find(&revisions)
+	logger.WithField("revisions", len(revisions)).Trace("Retrieved previous versions of message")
+
+	util.Responses.SuccessWithData(w, map[string]interface{}{
+		"message":   message,
+		"revisions": revisions,
+		"deleted":   message.DeletedAt != nil,
+	})
+	logger.Debug("Read edit history of message from specified chat")
+}
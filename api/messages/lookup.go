@@ -0,0 +1,59 @@
+package messages
+
+import (
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/akrantz01/apcsp/api/util"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+// Find a message in a chat by its uuid, responding with an error if it cannot be found
+//
+// Integer path parameters are still accepted as an index into the chat's messages ordered
+// by when they were sent, so older clients keep working until they switch to uuids
+func findMessage(w http.ResponseWriter, db *gorm.DB, chat database.Chat, param string, logger *logrus.Entry) (database.Message, bool) {
+	var message database.Message
+	query := db.Preload("Sender").Preload("File").Where("chat_id = ?", chat.ID)
+
+	// Look up by uuid
+	if _, err := uuid.FromString(param); err == nil {
+		query.Where("uuid = ?", param).First(&message)
+		if message.ID == 0 {
+			logger.Trace("Message does not exist in chat")
+			util.Responses.Error(w, http.StatusBadRequest, "specified message does not exist")
+			return message, false
+		}
+		logger.Trace("Retrieved message by uuid")
+		return message, true
+	}
+
+	// Fall back to deprecated index
+	index, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		logger.Trace("Invalid value for message uuid")
+		util.Responses.Error(w, http.StatusBadRequest, "path parameter 'message' must be a uuid")
+		return message, false
+	}
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Warning", `299 - "addressing messages by index is deprecated, use the message uuid"`)
+	logger.Trace("Converted deprecated message index to integer")
+
+	// Check integer bounds
+	if index < 0 {
+		logger.Trace("Message index is negative")
+		util.Responses.Error(w, http.StatusBadRequest, "message index is out of bounds")
+		return message, false
+	}
+	query.Order("id").Offset(index).First(&message)
+	if message.ID == 0 {
+		logger.Trace("Message index greater than total messages")
+		util.Responses.Error(w, http.StatusBadRequest, "message index is out of bounds")
+		return message, false
+	}
+	logger.Trace("Retrieved message by deprecated index")
+
+	return message, true
+}
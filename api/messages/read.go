@@ -7,7 +7,6 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 	"net/http"
-	"strconv"
 )
 
 func read(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
@@ -26,12 +25,12 @@ func read(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	}
 	logger.WithFields(logrus.Fields{"chat": vars["chat"], "message": vars["message"]}).Trace("Validated initial request on path parameters")
 
-	// Add chat id and message index to logger
+	// Add chat id and message uuid to logger
 	logger = logger.WithFields(logrus.Fields{"chat": vars["chat"], "message": vars["message"]})
 
 	// Check if chat exists
 	var chat database.Chat
-	db.Preload("Users").Preload("Messages").Preload("Messages.Sender").Preload("Messages.File").Where("uuid = ?", vars["chat"]).First(&chat)
+	db.Preload("Users").Where("uuid = ?", vars["chat"]).First(&chat)
 	if chat.ID == 0 {
 		logger.Trace("Chat does not exist")
 		util.Responses.Error(w, http.StatusBadRequest, "specified chat does not exist")
@@ -72,23 +71,12 @@ func read(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	}
 	logger.WithField("uid", uid).Trace("Retrieved chat from database")
 
-	// Convert path parameter to integer
-	index, err := strconv.ParseInt(vars["message"], 10, 64)
-	if err != nil {
-		logger.Trace("Invalid value for message index")
-		util.Responses.Error(w, http.StatusBadRequest, "message index must be an integer")
-		return
-	}
-	logger.Trace("Converted message index to integer")
-
-	// Check integer bounds
-	if index > int64(len(chat.Messages)-1) {
-		logger.WithField("total_messages", len(chat.Messages)-1).Trace("Message index greater than total messages")
-		util.Responses.Error(w, http.StatusBadRequest, "message index is out of bounds")
+	// Get message from chat
+	message, ok := findMessage(w, db, chat, vars["message"], logger)
+	if !ok {
 		return
 	}
-	logger.Trace("Validated message index not out of bounds")
 
-	util.Responses.SuccessWithData(w, chat.Messages[index])
+	util.Responses.SuccessWithData(w, message)
 	logger.Debug("Read message from specified chat")
 }
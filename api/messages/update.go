@@ -4,15 +4,15 @@ import (
 	"encoding/json"
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 	"net/http"
-	"strconv"
 	"time"
 )
 
-func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+func update(w http.ResponseWriter, r *http.Request, hub *websockets.Hub, db *gorm.DB) {
 	logger := logrus.WithFields(logrus.Fields{"app": "messages", "remote_address": r.RemoteAddr, "path": "/api/chats/{chat}/messages/{message}", "method": "PUT"})
 
 	// Validate initial request on path parameters, headers, and body
@@ -34,12 +34,12 @@ func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	}
 	logger.WithFields(logrus.Fields{"chat": vars["chat"], "message": vars["message"]}).Trace("Validated initial request on path parameters")
 
-	// Add chat id and message index to logger
+	// Add chat id and message uuid to logger
 	logger = logger.WithFields(logrus.Fields{"chat": vars["chat"], "message": vars["message"]})
 
 	// Check that chat exists
 	var chat database.Chat
-	db.Preload("Users").Preload("Messages").Where("uuid = ?", vars["chat"]).First(&chat)
+	db.Preload("Users").Where("uuid = ?", vars["chat"]).First(&chat)
 	if chat.ID == 0 {
 		logger.Trace("Chat does not exist")
 		util.Responses.Error(w, http.StatusBadRequest, "specified chat does not exist")
@@ -80,25 +80,18 @@ func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	}
 	logger.WithField("uid", uid).Trace("Confirmed requesting user in chat")
 
-	// Convert path parameter to integer
-	index, err := strconv.ParseInt(vars["message"], 10, 64)
-	if err != nil {
-		logger.Trace("Invalid value for message index")
-		util.Responses.Error(w, http.StatusBadRequest, "message index must be an integer")
+	// Get message from chat
+	message, ok := findMessage(w, db, chat, vars["message"], logger)
+	if !ok {
 		return
 	}
-	logger.Trace("Converted message index to integer")
 
-	// Check integer bounds
-	if index > int64(len(chat.Messages)-1) {
-		logger.WithField("total_messages", len(chat.Messages)-1).Trace("Message index greater than total messages")
-		util.Responses.Error(w, http.StatusBadRequest, "message index is out of bounds")
+	// Ensure requesting user sent the message
+	if message.SenderId != uid {
+		logger.WithFields(logrus.Fields{"uid": uid, "sender": message.SenderId}).Trace("User cannot edit message sent by another user")
+		util.Responses.Error(w, http.StatusForbidden, "only the sender can edit the message")
 		return
 	}
-	logger.Trace("Validated message index not out of bounds")
-
-	// Get message
-	message := chat.Messages[index]
 
 	// Parse JSON body
 	var body struct {
@@ -110,17 +103,32 @@ func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 		return
 	}
 
-	// Modify message if passed
-	if body.Message != "" {
+	// Modify message if passed, keeping the previous version
+	if body.Message != "" && body.Message != message.Message {
+		revision := database.MessageRevision{
+			MessageId: message.ID,
+			Message:   message.Message,
+			Timestamp: message.Timestamp,
+		}
+		if message.EditedAt != 0 {
+			revision.Timestamp = message.EditedAt
+		}
+		db.NewRecord(revision)
+		db.Create(&revision)
+		logger.Trace("Saved previous version of message")
+
 		message.Message = body.Message
-		message.Timestamp = time.Now().UnixNano()
+		message.EditedAt = time.Now().UnixNano()
 		logger.Trace("Set new message for chat")
 	}
 
-	// Save changes
-	db.Save(&message)
+	// Save changes without touching the preloaded sender and file
+	db.Set("gorm:save_associations", false).Save(&message)
 	logger.Trace("Saved updates to chat")
 
+	// Notify members of the edit
+	hub.PushChatEvent(chat.Users, websockets.EventMessageUpdated, chat.UUID, message)
+
 	util.Responses.Success(w)
 	logger.Debug("Updated message in chat with specified data")
 }
@@ -3,10 +3,12 @@ package main
 import (
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // Handle authentication for all endpoints
@@ -19,7 +21,7 @@ func authMiddleware(db *gorm.DB) func(next http.Handler) http.Handler {
 			logger = logrus.WithFields(logrus.Fields{"app": "middleware", "remote_address": r.RemoteAddr})
 
 			// Allow if authenticating
-			if r.RequestURI == "/api/auth/login" || (r.RequestURI == "/api/users" && r.Method == "POST") || r.RequestURI == "/api/ws" || strings.Index(r.RequestURI, "/api/auth/forgot-password") == 0 || strings.Index(r.RequestURI, "/api/auth/verify-email") == 0 || strings.Index(r.RequestURI, "/api/") == -1 {
+			if r.RequestURI == "/api/auth/login" || r.RequestURI == "/api/auth/refresh" || (r.RequestURI == "/api/users" && r.Method == "POST") || r.RequestURI == "/api/ws" || strings.Index(r.RequestURI, "/api/auth/forgot-password") == 0 || strings.Index(r.RequestURI, "/api/auth/verify-email") == 0 || strings.Index(r.RequestURI, "/api/auth/oidc/") == 0 || strings.Index(r.RequestURI, "/api/auth/magic-link") == 0 || strings.Index(r.RequestURI, "/api/") == -1 {
 				logger.WithField("uri", r.RequestURI).Trace("Unauthenticated route received")
 				next.ServeHTTP(w, r)
 				return
@@ -37,17 +39,76 @@ func authMiddleware(db *gorm.DB) func(next http.Handler) http.Handler {
 			tokenType := database.TokenAuthentication
 			if strings.Index(r.RequestURI, "/api/auth/reset-password") == 0 {
 				tokenType = database.TokenResetPassword
+			} else if r.RequestURI == "/api/auth/login/mfa" {
+				tokenType = database.TokenMFAPending
+			}
+
+			// Select scope required for personal access tokens
+			var scopes []string
+			if scope := routeScope(r); scope != "" {
+				scopes = append(scopes, scope)
 			}
 
 			// Validate JWT
-			_, err := util.JWT.Validate(r.Header.Get("Authorization"), tokenType, db)
+			token, err := util.JWT.Validate(r.Header.Get("Authorization"), tokenType, db, scopes...)
 			if err != nil {
 				util.Responses.Error(w, http.StatusUnauthorized, "invalid token: "+err.Error())
 				return
 			}
 			logger.Trace("Successfully validated authentication token")
 
+			// Ensure only administrators can use administration routes
+			if strings.Index(r.RequestURI, "/api/admin") == 0 {
+				uid, _ := util.JWT.UserId(token)
+				var user database.User
+				db.Where("id = ?", uid).First(&user)
+				if !user.HasRole(database.RoleAdmin) {
+					logger.WithField("uid", uid).Trace("User is not an administrator")
+					util.Responses.Error(w, http.StatusForbidden, "administrator role required")
+					return
+				}
+				logger.Trace("Ensured user is an administrator")
+			}
+
+			// Update last used time of session at most once a minute
+			db.Model(&database.Session{}).Where("uuid = (?) AND last_used < ?", db.Table("tokens").Select("family").Where("id = ?", util.JWT.TokenId(token)).QueryExpr(), time.Now().Add(-time.Minute)).Update("last_used", time.Now())
+			logger.Trace("Updated last used time of session")
+
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// Get the scope a personal access token requires for the matched route.
+// An empty string means personal access tokens are not allowed on the route.
+func routeScope(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+
+	// Get resource from route
+	var resource string
+	switch {
+	case strings.Index(template, "/api/chats/{chat}/messages") == 0:
+		resource = "messages"
+	case strings.Index(template, "/api/chats") == 0:
+		resource = "chats"
+	case strings.Index(template, "/api/files") == 0:
+		resource = "files"
+	case strings.Index(template, "/api/users") == 0:
+		resource = "users"
+	default:
+		return ""
+	}
+
+	// Reading only requires read scope
+	if r.Method == http.MethodGet {
+		return resource + ":read"
+	}
+	return resource + ":write"
+}
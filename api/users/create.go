@@ -2,13 +2,9 @@ package users
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -16,14 +12,17 @@ import (
 	"gopkg.in/hlandau/passlib.v1"
 	"html/template"
 	"net/http"
-	"time"
 )
 
 func create(w http.ResponseWriter, r *http.Request, db *gorm.DB, mail chan *gomail.Message, emailVerificationTemplate *template.Template) {
 	logger := logrus.WithFields(logrus.Fields{"app": "users", "remote_address": r.RemoteAddr, "path": "/api/users", "method": "POST"})
 
 	// Validate initial request on Content-Type header and body
-	if r.Header.Get("Content-Type") != "application/json" {
+	if viper.GetString("auth.backend") == "ldap" {
+		logger.Trace("Registration disabled when using directory")
+		util.Responses.Error(w, http.StatusForbidden, "registration is disabled, users are managed by the directory")
+		return
+	} else if r.Header.Get("Content-Type") != "application/json" {
 		logger.WithField("content_type", r.Header.Get("Content-Type")).Trace("Invalid content type")
 		util.Responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
 		return
@@ -99,43 +98,17 @@ func create(w http.ResponseWriter, r *http.Request, db *gorm.DB, mail chan *goma
 	db.Save(&user)
 	logger.Trace("Created user entry in database")
 
-	// Create signing key for JWT
-	signingKey := make([]byte, 128)
-	if _, err := rand.Read(signingKey); err != nil {
-		logger.WithError(err).Error("Unable to generate JWT signing key")
-		util.Responses.Error(w, http.StatusInternalServerError, "failed to generate JWT signing key")
-		return
-	}
-	logger.Trace("Generated new signing key bytes for JWT")
-
-	// Save key to database
-	storedToken := database.Token{
-		SigningKey: base64.StdEncoding.EncodeToString(signingKey),
-		UserId:     user.ID,
-		Type:       database.TokenVerification,
-	}
-	db.NewRecord(storedToken)
-	db.Create(&storedToken)
-	logger.Trace("Stored signing key and user id in database")
-
-	// Generate token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, &jwt.StandardClaims{
-		ExpiresAt: time.Now().Unix() + 60*60*24*3,
-		IssuedAt:  time.Now().Unix(),
-		NotBefore: time.Now().Unix(),
-		Subject:   fmt.Sprint(user.ID),
-	})
-	token.Header["kid"] = storedToken.ID
-	logger.Trace("Generated JWT claims")
-
-	// Sign token
-	signed, err := token.SignedString(signingKey)
+	// Generate verification token
+	signed, err := util.JWT.Create(&database.Token{
+		Type:   database.TokenVerification,
+		UserId: user.ID,
+	}, 60*60*24*3, db)
 	if err != nil {
-		logger.WithError(err).Error("Unable to sign JWT")
-		util.Responses.Error(w, http.StatusInternalServerError, "failed to sign JWT")
+		logger.WithError(err).Error("Unable to generate verification token")
+		util.Responses.Error(w, http.StatusInternalServerError, "failed to generate verification token")
 		return
 	}
-	logger.Trace("Signed JWT with signing key")
+	logger.Trace("Generated verification token")
 
 	// Render template to string
 	stringBuffer := bytes.NewBuffer([]byte{})
@@ -55,9 +55,11 @@ func deleteMethod(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	}
 
 	// Delete the user and all associated tokens
-	db.Delete(database.Token{}, "user_id = ?", user.ID)
+	util.JWT.Revoke(db, "user_id = ?", user.ID)
+	db.Delete(database.Session{}, "user_id = ?", user.ID)
+	db.Delete(database.RecoveryCode{}, "user_id = ?", user.ID)
 	db.Delete(&user)
-	logger.Trace("Revoked all tokens and deleted user")
+	logger.Trace("Revoked all tokens and sessions, and deleted user")
 
 	util.Responses.Success(w)
 	logger.Debug("Deleted all user information")
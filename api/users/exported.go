@@ -2,6 +2,7 @@ package users
 
 import (
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
 	"github.com/gobuffalo/packr/v2"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
@@ -37,14 +38,32 @@ func AllUsers(db *gorm.DB, mail chan *gomail.Message, box *packr.Box) func(w htt
 }
 
 // Methods pertaining to single users such as reading, updating, and deleting
-func SpecificUser(db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
+func SpecificUser(db *gorm.DB, hub *websockets.Hub, mail chan *gomail.Message, box *packr.Box) func(w http.ResponseWriter, r *http.Request) {
+	// Load email templates
+	templateString, err := box.FindString("verification.tmpl")
+	if err != nil {
+		logrus.WithError(err).Fatal("Unable to load verification template from box")
+	}
+	emailVerificationTemplate, err := template.New("verification-email").Parse(templateString)
+	if err != nil {
+		logrus.WithError(err).Fatal("Unable to load verification template")
+	}
+	templateString, err = box.FindString("email-changed.tmpl")
+	if err != nil {
+		logrus.WithError(err).Fatal("Unable to load email changed template from box")
+	}
+	emailChangedTemplate, err := template.New("email-changed-email").Parse(templateString)
+	if err != nil {
+		logrus.WithError(err).Fatal("Unable to load email changed template")
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			read(w, r, db)
+			read(w, r, db, hub)
 
 		case http.MethodPut:
-			update(w, r, db)
+			update(w, r, db, hub, mail, emailVerificationTemplate, emailChangedTemplate)
 
 		case http.MethodDelete:
 			deleteMethod(w, r, db)
@@ -3,13 +3,14 @@ package users
 import (
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 	"net/http"
 )
 
-func read(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+func read(w http.ResponseWriter, r *http.Request, db *gorm.DB, hub *websockets.Hub) {
 	logger := logrus.WithFields(logrus.Fields{"app": "users", "remote_address": r.RemoteAddr, "path": "/api/users/{user}", "method": "GET"})
 
 	// Validate initial request on path parameters
@@ -33,6 +34,10 @@ func read(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 		return
 	}
 
+	// Get whether the user is connected
+	user.Presence = hub.Presence(user)
+	logger.Trace("Got user presence")
+
 	util.Responses.SuccessWithData(w, user)
 	logger.Debug("Retrieved user from database")
 }
@@ -1,17 +1,22 @@
 package users
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/akrantz01/apcsp/api/database"
 	"github.com/akrantz01/apcsp/api/util"
+	"github.com/akrantz01/apcsp/api/websockets"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
 	"gopkg.in/hlandau/passlib.v1"
+	"html/template"
 	"net/http"
 )
 
-func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+func update(w http.ResponseWriter, r *http.Request, db *gorm.DB, hub *websockets.Hub, mail chan *gomail.Message, emailVerificationTemplate, emailChangedTemplate *template.Template) {
 	logger := logrus.WithFields(logrus.Fields{"app": "users", "remote_address": r.RemoteAddr, "path": "/api/users/{user}", "method": "PUT"})
 
 	// Validate initial request on path parameters, headers and body
@@ -69,6 +74,10 @@ func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 		Name     string `json:"name"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+
+		// Statuses can be cleared, so only change them if present
+		Status     *string `json:"status"`
+		StatusText *string `json:"status_text"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		logger.WithError(err).Trace("Invalid json body")
@@ -83,20 +92,42 @@ func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 		logger.Trace("Set new name for user")
 	}
 
-	// Modify email if passed
-	if body.Email != "" {
+	// Modify email if passed, waiting for the new address to be confirmed
+	changeEmail := body.Email != "" && body.Email != user.Email
+	if changeEmail {
 		// Validate length
 		if len(body.Email) < 5 || len(body.Email) > 254 {
 			logger.WithField("email", len(body.Email)).Trace("Invalid email length")
 			util.Responses.Error(w, http.StatusBadRequest, "field 'email' must be of length between 5 and 254")
 			return
+		} else if user.Source == database.SourceLDAP {
+			logger.Trace("Email is managed by directory")
+			util.Responses.Error(w, http.StatusBadRequest, "email is managed by the directory")
+			return
+		}
+
+		// Check if email is taken
+		var count int
+		db.Model(&database.User{}).Where("email = ?", body.Email).Count(&count)
+		if count != 0 {
+			logger.WithField("email", body.Email).Trace("Email is already taken")
+			util.Responses.Error(w, http.StatusConflict, "email is already taken")
+			return
 		}
-		user.Email = body.Email
-		logger.Trace("Set new email for user")
+
+		user.PendingEmail = body.Email
+		logger.Trace("Set pending email for user")
 	}
 
 	// Modify password if passed
 	if body.Password != "" {
+		// Passwords of directory users can only be changed in the directory
+		if user.Source == database.SourceLDAP {
+			logger.Trace("Password is managed by directory")
+			util.Responses.Error(w, http.StatusBadRequest, "password is managed by the directory")
+			return
+		}
+
 		// Validate length
 		if len(body.Password) != 64 {
 			logger.WithField("password", len(body.Password)).Trace("Invalid password length")
@@ -115,10 +146,94 @@ func update(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 		logger.Trace("Set new password for user")
 	}
 
+	// Modify status if passed
+	statusChanged := false
+	if body.Status != nil && *body.Status != user.Status {
+		if !database.ValidStatus(*body.Status) {
+			logger.WithField("status", *body.Status).Trace("Invalid status")
+			util.Responses.Error(w, http.StatusBadRequest, "field 'status' must be one of '', 'away', or 'dnd'")
+			return
+		}
+
+		user.Status = *body.Status
+		statusChanged = true
+		logger.Trace("Set new status for user")
+	}
+	if body.StatusText != nil && *body.StatusText != user.StatusText {
+		if len(*body.StatusText) > 128 {
+			logger.WithField("status_text", len(*body.StatusText)).Trace("Invalid status text length")
+			util.Responses.Error(w, http.StatusBadRequest, "field 'status_text' must be at most 128 characters")
+			return
+		}
+
+		user.StatusText = *body.StatusText
+		statusChanged = true
+		logger.Trace("Set new status text for user")
+	}
+
 	// Save changes
 	db.Save(&user)
 	logger.Trace("Saved new user information to database")
 
+	// Send confirmation to the new email and notify the old one
+	if changeEmail {
+		if err := sendEmailChange(db, user, mail, emailVerificationTemplate, emailChangedTemplate); err != nil {
+			logger.WithError(err).Error("Unable to send email change confirmation")
+			util.Responses.Error(w, http.StatusInternalServerError, "failed to send email change confirmation")
+			return
+		}
+		logger.Trace("Sent email change confirmation")
+	}
+
+	// Notify users sharing a chat of the new status
+	if statusChanged {
+		hub.PushPresence(user)
+		logger.Trace("Pushed new presence to users sharing a chat")
+	}
+
 	util.Responses.Success(w)
 	logger.Debug("Updated user with specified data")
 }
+
+// Send a confirmation link to a user's pending email and notify their current email of the change
+func sendEmailChange(db *gorm.DB, user database.User, mail chan *gomail.Message, emailVerificationTemplate, emailChangedTemplate *template.Template) error {
+	// Replace any previous email change tokens so only the newest email can be confirmed
+	util.JWT.Revoke(db, "user_id = ? AND type = ?", user.ID, database.TokenChangeEmail)
+
+	// Generate email change token
+	signed, err := util.JWT.Create(&database.Token{
+		Type:   database.TokenChangeEmail,
+		UserId: user.ID,
+	}, 60*60*24*3, db)
+	if err != nil {
+		return err
+	}
+
+	// Render templates to strings
+	verificationBuffer := bytes.NewBuffer([]byte{})
+	if err := emailVerificationTemplate.Execute(verificationBuffer, map[string]string{"name": user.Name, "domain": viper.GetString("http.domain"), "token": signed}); err != nil {
+		return err
+	}
+	changedBuffer := bytes.NewBuffer([]byte{})
+	if err := emailChangedTemplate.Execute(changedBuffer, map[string]string{"name": user.Name, "email": user.PendingEmail}); err != nil {
+		return err
+	}
+
+	// Assemble and send confirmation email
+	m := gomail.NewMessage()
+	m.SetHeader("From", viper.GetString("email.sender"))
+	m.SetHeader("To", user.PendingEmail)
+	m.SetHeader("Subject", "Chat App - Verify Your Email")
+	m.SetBody("text/html", verificationBuffer.String())
+	mail <- m
+
+	// Assemble and send notification email
+	m = gomail.NewMessage()
+	m.SetHeader("From", viper.GetString("email.sender"))
+	m.SetHeader("To", user.Email)
+	m.SetHeader("Subject", "Chat App - Your Email is Changing")
+	m.SetBody("text/html", changedBuffer.String())
+	mail <- m
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -8,7 +9,9 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"strconv"
+	"time"
 )
 
 var JWT = jwtClass{}
@@ -17,17 +20,104 @@ type jwtClass struct{}
 
 var jwtLogger = logrus.WithField("app", "jwt")
 
+// Generate a new token for the given stored token information.
+// The stored token must have its type and user id set, and will be saved to the database.
+// An expiration of 0 creates a token that never expires.
+// Depending on the configured mode, the token is signed with its own HMAC key or the current asymmetric key.
+func (j jwtClass) Create(storedToken *database.Token, expiration int64, db *gorm.DB) (string, error) {
+	// Set expiration for revocation and key pruning
+	if expiration > 0 {
+		expiresAt := time.Now().Add(time.Duration(expiration) * time.Second)
+		storedToken.ExpiresAt = &expiresAt
+	}
+
+	// Get signing key for JWT
+	var method jwt.SigningMethod
+	var key interface{}
+	if algorithm, ok := modeAlgorithms[viper.GetString("jwt.mode")]; ok {
+		signingKey, private, err := j.currentKey(db, algorithm)
+		if err != nil {
+			jwtLogger.WithError(err).Trace("Unable to get current signing key")
+			return "", err
+		}
+		storedToken.KeyId = signingKey.KeyId
+		method = jwt.GetSigningMethod(algorithm)
+		key = private
+		jwtLogger.WithField("key_id", signingKey.KeyId).Trace("Got current asymmetric signing key for JWT")
+	} else {
+		signingKey := make([]byte, 128)
+		if _, err := rand.Read(signingKey); err != nil {
+			jwtLogger.WithError(err).Trace("Unable to generate JWT signing key")
+			return "", fmt.Errorf("failed to generate JWT signing key: %v", err)
+		}
+		storedToken.SigningKey = base64.StdEncoding.EncodeToString(signingKey)
+		method = jwt.SigningMethodHS512
+		key = signingKey
+		jwtLogger.Trace("Generated new signing key bytes for JWT")
+	}
+
+	// Save token information to database
+	db.NewRecord(storedToken)
+	db.Create(storedToken)
+	jwtLogger.WithFields(logrus.Fields{"token_id": storedToken.ID, "type": storedToken.Type}).Trace("Stored token information in database")
+
+	// Generate token with claims
+	claims := jwt.MapClaims{
+		"iat":  time.Now().Unix(),
+		"nbf":  time.Now().Unix(),
+		"sub":  fmt.Sprint(storedToken.UserId),
+		"jti":  fmt.Sprint(storedToken.ID),
+		"type": storedToken.Type,
+	}
+	if expiration > 0 {
+		claims["exp"] = storedToken.ExpiresAt.Unix()
+	}
+	if storedToken.Scopes != "" {
+		claims["scope"] = storedToken.Scopes
+	}
+	if storedToken.Family != "" {
+		claims["sid"] = storedToken.Family
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if storedToken.KeyId != "" {
+		token.Header["kid"] = storedToken.KeyId
+	} else {
+		token.Header["kid"] = storedToken.ID
+	}
+	jwtLogger.Trace("Generated JWT claims")
+
+	// Sign token
+	signed, err := token.SignedString(key)
+	if err != nil {
+		jwtLogger.WithError(err).Trace("Unable to sign JWT")
+		return "", fmt.Errorf("failed to sign JWT: %v", err)
+	}
+	jwtLogger.WithField("token_id", storedToken.ID).Trace("Signed JWT with signing key")
+
+	return signed, nil
+}
+
 // Validate an authentication token given the signed string.
-func (j jwtClass) Validate(tokenString string, tokenType int, db *gorm.DB) (*jwt.Token, error) {
+// Personal access tokens are accepted in place of authentication tokens if they have all the given scopes.
+// Tokens signed with an asymmetric key are verified from their claims and checked against the revoked tokens.
+func (j jwtClass) Validate(tokenString string, tokenType int, db *gorm.DB, scopes ...string) (*jwt.Token, error) {
 	// Retrieve token
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (i interface{}, e error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			jwtLogger.WithField("method", token.Header["alg"]).Trace("Invalid signing method for JWT")
-			return nil, fmt.Errorf("unexpected signing message: %v", token.Header["alg"])
-		} else if _, ok := token.Header["kid"]; !ok {
+		if _, ok := token.Header["kid"]; !ok {
 			jwtLogger.Trace("No key id in token")
 			return nil, fmt.Errorf("unable to find key id in token")
 		}
+
+		// Get public key for asymmetric tokens
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *signingMethodEdDSA:
+			jwtLogger.WithField("key_id", token.Header["kid"]).Trace("Validated token header/parts")
+			return j.publicKey(db, fmt.Sprint(token.Header["kid"]), token.Method.Alg())
+		case *jwt.SigningMethodHMAC:
+		default:
+			jwtLogger.WithField("method", token.Header["alg"]).Trace("Invalid signing method for JWT")
+			return nil, fmt.Errorf("unexpected signing message: %v", token.Header["alg"])
+		}
 		jwtLogger.Trace("Validated token header/parts")
 
 		// Get signing key from database
@@ -39,9 +129,10 @@ func (j jwtClass) Validate(tokenString string, tokenType int, db *gorm.DB) (*jwt
 		}
 		jwtLogger.WithField("key_id", token.Header["kid"]).Trace("Retrieved token signing key from database")
 
-		// Ensure token is of proper type
-		if t.Type != uint(tokenType) {
-			return nil, errors.New("invalid token type")
+		// Ensure token is of proper type and has the required scopes
+		if err := checkToken(t.Type, t.Scopes, tokenType, scopes); err != nil {
+			jwtLogger.WithError(err).WithField("key_id", token.Header["kid"]).Trace("Token not allowed")
+			return nil, err
 		}
 
 		// Decode signing key
@@ -64,11 +155,70 @@ func (j jwtClass) Validate(tokenString string, tokenType int, db *gorm.DB) (*jwt
 		jwtLogger.Trace("Invalid token")
 		return nil, fmt.Errorf("token is invalid")
 	}
+
+	// Check claims and revocation of asymmetric tokens
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		claims := j.Claims(token)
+		storedType, _ := claims["type"].(float64)
+		storedScopes, _ := claims["scope"].(string)
+		if err := checkToken(uint(storedType), storedScopes, tokenType, scopes); err != nil {
+			jwtLogger.WithError(err).Trace("Token not allowed")
+			return nil, err
+		}
+
+		var revoked database.RevokedToken
+		db.Where("token_id = ?", j.TokenId(token)).First(&revoked)
+		if revoked.ID != 0 {
+			jwtLogger.WithField("token_id", j.TokenId(token)).Trace("Token was revoked")
+			return nil, errors.New("token was revoked")
+		}
+	}
 	jwtLogger.Trace("Valid token for given user")
 
 	return token, nil
 }
 
+// Ensure a token's type is allowed and it has the required scopes
+func checkToken(storedType uint, storedScopes string, tokenType int, scopes []string) error {
+	if storedType == database.TokenPersonalAccess && tokenType == database.TokenAuthentication {
+		if len(scopes) == 0 {
+			return errors.New("personal access tokens cannot be used for this route")
+		}
+		t := database.Token{Type: storedType, Scopes: storedScopes}
+		for _, scope := range scopes {
+			if !t.HasScope(scope) {
+				return fmt.Errorf("token missing required scope: %s", scope)
+			}
+		}
+	} else if storedType != uint(tokenType) {
+		return errors.New("invalid token type")
+	}
+	return nil
+}
+
+// Revoke all tokens matching the query.
+// Asymmetric tokens are added to the revoked tokens as they can be verified without their stored information.
+func (j jwtClass) Revoke(db *gorm.DB, query interface{}, args ...interface{}) {
+	var tokens []database.Token
+	db.Where(query, args...).Find(&tokens)
+
+	for _, t := range tokens {
+		if t.KeyId != "" {
+			revoked := database.RevokedToken{
+				TokenId:   fmt.Sprint(t.ID),
+				ExpiresAt: t.ExpiresAt,
+			}
+			db.NewRecord(revoked)
+			db.Create(&revoked)
+		}
+		db.Delete(&t)
+	}
+	jwtLogger.WithField("count", len(tokens)).Trace("Revoked tokens")
+
+	// Remove revoked tokens that have expired anyways
+	db.Unscoped().Delete(database.RevokedToken{}, "expires_at < ?", time.Now())
+}
+
 // Check specified user and user from JWT are the same
 func (j jwtClass) CheckUser(token *jwt.Token, user database.User, db *gorm.DB) (bool, error) {
 	// Retrieve token claims
@@ -136,3 +286,16 @@ func (j jwtClass) UserId(token *jwt.Token) (uint, error) {
 
 	return uint(id), nil
 }
+
+// Get the id of the stored token information from a token
+func (j jwtClass) TokenId(token *jwt.Token) string {
+	if id, ok := j.Claims(token)["jti"].(string); ok {
+		return id
+	}
+
+	// Tokens issued before the id claim use the key id
+	if id, ok := token.Header["kid"].(float64); ok {
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	}
+	return fmt.Sprint(token.Header["kid"])
+}
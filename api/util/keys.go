@@ -0,0 +1,184 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Signing algorithm for each asymmetric mode
+var modeAlgorithms = map[string]string{
+	"rs256": "RS256",
+	"eddsa": "EdDSA",
+}
+
+// Cache of parsed public keys by key id so verification does not need the database
+var publicKeys = sync.Map{}
+
+// Prevent concurrent key rotations
+var rotation = sync.Mutex{}
+
+// Get the current signing key for an algorithm, generating a new one if it should be rotated
+func (j jwtClass) currentKey(db *gorm.DB, algorithm string) (database.SigningKey, crypto.Signer, error) {
+	rotation.Lock()
+	defer rotation.Unlock()
+	interval := time.Duration(viper.GetInt("jwt.rotation")) * time.Second
+
+	// Use newest key if it is not due for rotation
+	var signingKey database.SigningKey
+	db.Where("algorithm = ? AND created_at > ?", algorithm, time.Now().Add(-interval)).Order("created_at desc").First(&signingKey)
+	if signingKey.ID != 0 {
+		private, err := parsePrivateKey(signingKey.PrivateKey)
+		return signingKey, private, err
+	}
+	jwtLogger.WithField("algorithm", algorithm).Debug("Rotating signing key")
+
+	// Generate new key pair
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return signingKey, nil, fmt.Errorf("unknown signing algorithm: %s", algorithm)
+	}
+	if err != nil {
+		return signingKey, nil, fmt.Errorf("failed to generate signing key: %v", err)
+	}
+
+	// Encode keys for storage
+	privateBytes, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return signingKey, nil, fmt.Errorf("failed to encode private key: %v", err)
+	}
+	publicBytes, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return signingKey, nil, fmt.Errorf("failed to encode public key: %v", err)
+	}
+
+	// Save key to database
+	signingKey = database.SigningKey{
+		KeyId:      uuid.NewV4().String(),
+		Algorithm:  algorithm,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateBytes})),
+		PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes})),
+	}
+	db.NewRecord(signingKey)
+	db.Create(&signingKey)
+	jwtLogger.WithFields(logrus.Fields{"key_id": signingKey.KeyId, "algorithm": algorithm}).Trace("Stored new signing key")
+
+	j.pruneKeys(db, interval)
+
+	return signingKey, private, nil
+}
+
+// Remove rotated keys that no longer have any unexpired tokens signed with them
+func (j jwtClass) pruneKeys(db *gorm.DB, interval time.Duration) {
+	var keys []database.SigningKey
+	db.Where("created_at < ? AND key_id NOT IN (?)", time.Now().Add(-interval),
+		db.Table("tokens").Select("DISTINCT key_id").Where("deleted_at IS NULL AND key_id <> '' AND (expires_at IS NULL OR expires_at > ?)", time.Now()).QueryExpr()).Find(&keys)
+
+	for _, key := range keys {
+		db.Unscoped().Delete(&key)
+		publicKeys.Delete(key.KeyId)
+		jwtLogger.WithField("key_id", key.KeyId).Trace("Pruned unused signing key")
+	}
+}
+
+// Get the public key for a key id, verifying it is for the expected algorithm
+func (j jwtClass) publicKey(db *gorm.DB, keyId, algorithm string) (crypto.PublicKey, error) {
+	var signingKey database.SigningKey
+	if cached, ok := publicKeys.Load(keyId); ok {
+		signingKey = cached.(database.SigningKey)
+	} else {
+		db.Where("key_id = ?", keyId).First(&signingKey)
+		if signingKey.ID == 0 {
+			jwtLogger.WithField("key_id", keyId).Trace("No signing key for token")
+			return nil, fmt.Errorf("unable to find signing key for token: %s", keyId)
+		}
+		publicKeys.Store(keyId, signingKey)
+	}
+
+	// Prevent keys from being used with another algorithm
+	if signingKey.Algorithm != algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %s", algorithm)
+	}
+
+	return parsePublicKey(signingKey.PublicKey)
+}
+
+// Get the JSON web key set of all public keys that tokens may be signed with
+func (j jwtClass) KeySet(db *gorm.DB) ([]map[string]interface{}, error) {
+	var signingKeys []database.SigningKey
+	db.Order("created_at desc").Find(&signingKeys)
+
+	keys := []map[string]interface{}{}
+	for _, signingKey := range signingKeys {
+		public, err := parsePublicKey(signingKey.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		// Format based on key type
+		key := map[string]interface{}{
+			"kid": signingKey.KeyId,
+			"alg": signingKey.Algorithm,
+			"use": "sig",
+		}
+		switch public := public.(type) {
+		case *rsa.PublicKey:
+			key["kty"] = "RSA"
+			key["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			key["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			key["kty"] = "OKP"
+			key["crv"] = "Ed25519"
+			key["x"] = base64.RawURLEncoding.EncodeToString(public)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Decode a PEM encoded PKCS8 private key
+func parsePrivateKey(encoded string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("unable to decode private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %v", err)
+	}
+	return key.(crypto.Signer), nil
+}
+
+// Decode a PEM encoded PKIX public key
+func parsePublicKey(encoded string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("unable to decode public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,146 @@
+package util
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/ldap.v3"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var LDAP = ldapClass{}
+
+type ldapClass struct{}
+
+var ldapLogger = logrus.WithField("app", "ldap")
+
+var (
+	// The username does not exist in the directory or the password is wrong
+	ErrLDAPInvalidCredentials = errors.New("invalid username or password")
+
+	// The user is not a member of the group required to login
+	ErrLDAPNotPermitted = errors.New("user is not permitted to login")
+
+	// The connection would send passwords in plaintext
+	ErrLDAPInsecure = errors.New("refusing to bind without tls, use ldaps:// or enable ldap.start_tls")
+)
+
+// Information about a user synced from the directory
+type LDAPUser struct {
+	DN    string
+	Name  string
+	Email string
+}
+
+// Check a user's credentials against the directory, returning their attributes if they are valid
+func (l ldapClass) Authenticate(username, password string) (LDAPUser, error) {
+	var user LDAPUser
+
+	// Prevent anonymous binds from being treated as a successful login
+	if password == "" {
+		return user, ErrLDAPInvalidCredentials
+	}
+
+	conn, err := l.connect()
+	if err != nil {
+		return user, err
+	}
+	defer conn.Close()
+
+	// Bind as the service account to search for the user
+	if err := conn.Bind(viper.GetString("ldap.bind_dn"), viper.GetString("ldap.bind_password")); err != nil {
+		return user, fmt.Errorf("failed to bind as service account: %v", err)
+	}
+
+	// Find the user's entry
+	nameAttribute := viper.GetString("ldap.name_attribute")
+	emailAttribute := viper.GetString("ldap.email_attribute")
+	search := ldap.NewSearchRequest(
+		viper.GetString("ldap.base_dn"), ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(viper.GetString("ldap.user_filter"), ldap.EscapeFilter(username)),
+		[]string{nameAttribute, emailAttribute}, nil,
+	)
+	result, err := conn.Search(search)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return user, fmt.Errorf("failed to search for user: %v", err)
+	} else if result == nil || len(result.Entries) != 1 {
+		ldapLogger.WithField("username", username).Trace("User not found in directory")
+		return user, ErrLDAPInvalidCredentials
+	}
+	entry := result.Entries[0]
+	user = LDAPUser{
+		DN:    entry.DN,
+		Name:  entry.GetAttributeValue(nameAttribute),
+		Email: entry.GetAttributeValue(emailAttribute),
+	}
+	ldapLogger.WithFields(logrus.Fields{"username": username, "dn": user.DN}).Trace("Found user in directory")
+
+	// Check password by binding as the user
+	if err := conn.Bind(user.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return user, ErrLDAPInvalidCredentials
+	} else if err != nil {
+		return user, fmt.Errorf("failed to bind as user: %v", err)
+	}
+	ldapLogger.WithField("dn", user.DN).Trace("Validated user password")
+
+	// Ensure user is in the required group if there is one
+	group := viper.GetString("ldap.required_group")
+	if group == "" {
+		return user, nil
+	}
+	if err := conn.Bind(viper.GetString("ldap.bind_dn"), viper.GetString("ldap.bind_password")); err != nil {
+		return user, fmt.Errorf("failed to bind as service account: %v", err)
+	}
+	membership := ldap.NewSearchRequest(
+		group, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 10, false,
+		fmt.Sprintf("(%s=%s)", viper.GetString("ldap.group_attribute"), ldap.EscapeFilter(user.DN)),
+		[]string{"dn"}, nil,
+	)
+	result, err = conn.Search(membership)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return user, fmt.Errorf("failed to search for group membership: %v", err)
+	} else if result == nil || len(result.Entries) == 0 {
+		ldapLogger.WithFields(logrus.Fields{"dn": user.DN, "group": group}).Trace("User not in required group")
+		return user, ErrLDAPNotPermitted
+	}
+	ldapLogger.WithFields(logrus.Fields{"dn": user.DN, "group": group}).Trace("User is in required group")
+
+	return user, nil
+}
+
+// Check if connections to the directory are encrypted
+func (l ldapClass) Secure() bool {
+	return strings.HasPrefix(viper.GetString("ldap.url"), "ldaps://") || viper.GetBool("ldap.start_tls")
+}
+
+// Open a connection to the directory, upgrading it to TLS if configured
+func (l ldapClass) connect() (*ldap.Conn, error) {
+	// Never send credentials over an unencrypted connection
+	if !l.Secure() {
+		return nil, ErrLDAPInsecure
+	}
+
+	address := viper.GetString("ldap.url")
+	conn, err := ldap.DialURL(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to directory: %v", err)
+	}
+	conn.SetTimeout(10 * time.Second)
+
+	if viper.GetBool("ldap.start_tls") && !strings.HasPrefix(address, "ldaps://") {
+		host := address
+		if parsed, err := url.Parse(address); err == nil {
+			host = parsed.Hostname()
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start tls: %v", err)
+		}
+	}
+
+	return conn, nil
+}
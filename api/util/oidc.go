@@ -0,0 +1,320 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var OIDC = oidcClass{}
+
+type oidcClass struct{}
+
+var oidcLogger = logrus.WithField("app", "oidc")
+
+// Client for requests to identity providers
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// How long discovered provider information is cached for
+const oidcCacheDuration = time.Hour
+
+// Configuration and discovered endpoints of an OpenID Connect provider
+type OIDCProvider struct {
+	Name         string
+	Issuer       string `json:"issuer"`
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	// Signing keys by key id
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	fetched     time.Time
+	lock        sync.Mutex
+}
+
+// Discovered providers by name
+var oidcProviders = sync.Map{}
+
+// Get a configured provider, discovering its endpoints if they are not cached
+func (o oidcClass) Provider(name string) (*OIDCProvider, error) {
+	name = strings.ToLower(name)
+	prefix := "oidc.providers." + name
+	if !viper.IsSet(prefix + ".issuer") {
+		return nil, fmt.Errorf("unknown provider: %s", name)
+	}
+
+	// Use cached provider if not expired
+	if cached, ok := oidcProviders.Load(name); ok && time.Since(cached.(*OIDCProvider).fetched) < oidcCacheDuration {
+		return cached.(*OIDCProvider), nil
+	}
+
+	// Load provider configuration
+	provider := &OIDCProvider{
+		Name:         name,
+		ClientId:     viper.GetString(prefix + ".client_id"),
+		ClientSecret: viper.GetString(prefix + ".client_secret"),
+		Scopes:       []string{"openid", "email", "profile"},
+	}
+	if viper.IsSet(prefix + ".scopes") {
+		provider.Scopes = viper.GetStringSlice(prefix + ".scopes")
+	}
+	issuer := strings.TrimSuffix(viper.GetString(prefix+".issuer"), "/")
+
+	// Discover provider endpoints
+	if err := oidcGet(issuer+"/.well-known/openid-configuration", provider); err != nil {
+		oidcLogger.WithError(err).WithField("provider", name).Trace("Unable to discover provider configuration")
+		return nil, fmt.Errorf("failed to discover provider configuration: %v", err)
+	} else if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		oidcLogger.WithFields(logrus.Fields{"provider": name, "issuer": provider.Issuer}).Trace("Discovered issuer does not match configuration")
+		return nil, fmt.Errorf("discovered issuer does not match: %s", provider.Issuer)
+	}
+	provider.fetched = time.Now()
+	oidcLogger.WithField("provider", name).Trace("Discovered provider configuration")
+
+	// Get provider signing keys
+	if err := provider.refreshKeys(); err != nil {
+		return nil, err
+	}
+
+	oidcProviders.Store(name, provider)
+	return provider, nil
+}
+
+// Get the URL to send the user to for logging in with PKCE
+func (p *OIDCProvider) AuthorizationURL(redirectURI, state, nonce, challenge string) string {
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientId)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", challenge)
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// Exchange an authorization code for an ID token
+func (p *OIDCProvider) Exchange(code, redirectURI, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.ClientId)
+	form.Set("client_secret", p.ClientSecret)
+	form.Set("code_verifier", verifier)
+
+	// Request tokens
+	response, err := oidcClient.PostForm(p.TokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("failed to request token: %v", err)
+	}
+	defer response.Body.Close()
+
+	// Parse response
+	var body struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("unable to decode token response: %v", err)
+	} else if body.Error != "" {
+		return "", fmt.Errorf("provider returned error: %s %s", body.Error, body.ErrorDescription)
+	} else if body.IdToken == "" {
+		return "", errors.New("provider did not return an id token")
+	}
+	oidcLogger.WithField("provider", p.Name).Trace("Exchanged authorization code for id token")
+
+	return body.IdToken, nil
+}
+
+// Verify the signature and claims of an ID token, returning its claims
+func (p *OIDCProvider) Verify(idToken, nonce string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return p.key(kid)
+	})
+	if err != nil {
+		oidcLogger.WithError(err).WithField("provider", p.Name).Trace("Invalid id token")
+		return nil, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	// Validate expiration, issuer, audience and nonce
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("missing expiration")
+	} else if !claims.VerifyIssuer(p.Issuer, true) {
+		return nil, errors.New("invalid issuer")
+	} else if !claims.VerifyAudience(p.ClientId, true) && !containsAudience(claims["aud"], p.ClientId) {
+		return nil, errors.New("invalid audience")
+	} else if azp, ok := claims["azp"].(string); ok && azp != p.ClientId {
+		return nil, errors.New("invalid authorized party")
+	} else if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, errors.New("invalid nonce")
+	}
+	oidcLogger.WithField("provider", p.Name).Trace("Verified id token")
+
+	return claims, nil
+}
+
+// Get a signing key by id, refreshing the keys if it is not found
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	p.lock.Lock()
+	key, ok := p.keys[kid]
+	if !ok && kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			key, ok = k, true
+		}
+	}
+	p.lock.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	// Keys may have been rotated by the provider, but prevent unknown ids from causing constant refreshes
+	p.lock.Lock()
+	recent := time.Since(p.keysFetched) < time.Minute
+	p.lock.Unlock()
+	if recent {
+		return nil, fmt.Errorf("unable to find signing key: %s", kid)
+	}
+	if err := p.refreshKeys(); err != nil {
+		return nil, err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unable to find signing key: %s", kid)
+}
+
+// Fetch the provider signing keys
+func (p *OIDCProvider) refreshKeys() error {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oidcGet(p.JWKSURI, &set); err != nil {
+		oidcLogger.WithError(err).WithField("provider", p.Name).Trace("Unable to fetch provider signing keys")
+		return fmt.Errorf("failed to fetch provider signing keys: %v", err)
+	}
+
+	// Parse supported keys
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				continue
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				continue
+			}
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	p.lock.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.lock.Unlock()
+	oidcLogger.WithFields(logrus.Fields{"provider": p.Name, "count": len(keys)}).Trace("Fetched provider signing keys")
+
+	return nil
+}
+
+// Check if an audience claim list contains the client id
+func containsAudience(aud interface{}, clientId string) bool {
+	list, ok := aud.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, a := range list {
+		if a == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+// Get and decode a JSON document from a provider
+func oidcGet(address string, v interface{}) error {
+	response, err := oidcClient.Get(address)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var TOTP = totpClass{}
+
+type totpClass struct{}
+
+var totpLogger = logrus.WithField("app", "totp")
+
+// TOTP parameters as recommended by RFC 6238
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1
+)
+
+// Generate a new random base32 encoded secret
+func (t totpClass) Secret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		totpLogger.WithError(err).Trace("Unable to generate TOTP secret")
+		return "", fmt.Errorf("failed to generate secret: %v", err)
+	}
+	totpLogger.Trace("Generated new TOTP secret")
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// Get the provisioning URL for authenticator apps
+func (t totpClass) URL(secret, issuer, account string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Generate the code for a secret at a given time step
+func (t totpClass) Code(secret string, step int64) (string, error) {
+	// Decode the secret
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		totpLogger.WithError(err).Trace("Unable to decode TOTP secret")
+		return "", fmt.Errorf("unable to decode secret: %v", err)
+	}
+
+	// Compute HMAC of the time step
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// Dynamically truncate to the number of digits
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo), nil
+}
+
+// Validate a code for a secret, allowing for clock skew between devices.
+// Codes from time steps at or before the last used step are rejected to prevent replays.
+// The time step the code matched is returned so that it can be stored as the last used step.
+func (t totpClass) Validate(secret, code string, lastStep int64) (int64, bool) {
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		// Prevent code reuse
+		if step <= lastStep {
+			continue
+		}
+
+		// Compare against the expected code
+		expected, err := t.Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			totpLogger.WithField("step", step).Trace("Validated TOTP code")
+			return step, true
+		}
+	}
+
+	totpLogger.Trace("Invalid TOTP code")
+	return 0, false
+}
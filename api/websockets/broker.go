@@ -0,0 +1,121 @@
+package websockets
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// Fans out messages to every instance of the API, so users receive events
+// no matter which instance their websocket is connected to
+//
+// Implementations only need to deliver each published payload to every subscribed
+// handler, including the one on the publishing instance. Payloads are small and
+// refer to the event log rather than containing events, so ordering and missed
+// payloads are tolerated by the hub.
+type Broker interface {
+	// Send a payload to every instance
+	Publish(payload []byte) error
+
+	// Call the handler with every payload published by any instance
+	Subscribe(handler func(payload []byte)) error
+
+	// Stop receiving payloads
+	Close() error
+}
+
+// Delivers payloads within a single instance
+type localBroker struct {
+	handler func(payload []byte)
+}
+
+func NewLocalBroker() Broker {
+	return &localBroker{}
+}
+
+func (b *localBroker) Publish(payload []byte) error {
+	if b.handler != nil {
+		b.handler(payload)
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(handler func(payload []byte)) error {
+	b.handler = handler
+	return nil
+}
+
+func (b *localBroker) Close() error {
+	return nil
+}
+
+// Delivers payloads between instances sharing a database with Postgres LISTEN/NOTIFY
+type postgresBroker struct {
+	db       *gorm.DB
+	channel  string
+	listener *pq.Listener
+	logger   *logrus.Entry
+}
+
+func NewPostgresBroker(db *gorm.DB, connection string, channel string) Broker {
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "broker": "postgres", "channel": channel})
+
+	return &postgresBroker{
+		db:      db,
+		channel: channel,
+		listener: pq.NewListener(connection, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+			switch event {
+			case pq.ListenerEventConnectionAttemptFailed:
+				logger.WithError(err).Error("Failed to connect to database for notifications")
+			case pq.ListenerEventDisconnected:
+				logger.WithError(err).Warn("Lost connection to database for notifications, reconnecting")
+			case pq.ListenerEventReconnected:
+				logger.Info("Reconnected to database for notifications")
+			}
+		}),
+		logger: logger,
+	}
+}
+
+func (b *postgresBroker) Publish(payload []byte) error {
+	return b.db.Exec("SELECT pg_notify(?, ?)", b.channel, string(payload)).Error
+}
+
+func (b *postgresBroker) Subscribe(handler func(payload []byte)) error {
+	if err := b.listener.Listen(b.channel); err != nil {
+		return err
+	}
+	b.logger.Info("Listening for websocket events from other instances")
+
+	go func() {
+		for {
+			select {
+			case notification, ok := <-b.listener.Notify:
+				if !ok {
+					return
+				}
+
+				// Notifications may have been lost while reconnecting, these are
+				// recovered from the event log with the next event for each user
+				if notification == nil {
+					b.logger.Trace("Reconnected, notifications may have been missed")
+					continue
+				}
+				handler([]byte(notification.Extra))
+
+			// Ensure the connection is still alive
+			case <-time.After(90 * time.Second):
+				if err := b.listener.Ping(); err != nil {
+					b.logger.WithError(err).Warn("Failed to ping database for notifications")
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *postgresBroker) Close() error {
+	return b.listener.Close()
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -18,7 +19,10 @@ const (
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	maxMessageSize = 64 * 1024
+
+	// Messages queued for a connection, enough for a full replay of missed events
+	sendBuffer = maxReplay + 256
 )
 
 // Upgrade connection to websocket
@@ -34,15 +38,61 @@ var upgrader = websocket.Upgrader{
 type Client struct {
 	hub *Hub
 
+	// Unique id of the connection
+	id string
+
 	// The websocket connection
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages
 	send chan []byte
 
+	// Closed once the connection is closed to stop the writer and any pending deliveries
+	done chan struct{}
+
+	// Connection metadata for administrators
+	device        string
+	userAgent     string
+	remoteAddress string
+	forwardedFor  string
+	connectedAt   time.Time
+
 	// Access to the database
 	db *gorm.DB
 
+	// Login session the connection was authenticated with
+	session string
+
+	// Token the connection was authenticated with
+	token database.Token
+
+	// User the connection was authenticated as, set when subscribing to events
+	userId uint
+
+	// Chats and events the connection receives
+	subscriptions *subscriptions
+
+	// Keeps events in sequence order while they are delivered to the connection
+	events sync.Mutex
+
+	// Whether new messages are sent as message.created events, set when subscribing to events
+	envelope bool
+
+	// Sequence numbers of the last event sent and acknowledged, and when the oldest unacknowledged
+	// event was sent, only accessed while holding the event lock
+	lastSeq      uint64
+	acks         bool
+	ackedSeq     uint64
+	unackedSince time.Time
+
+	// Sequence number of the last event sent that the connection is subscribed to,
+	// only accessed while holding the event lock
+	lastDelivered uint64
+
+	// Typing messages received in the current window, only accessed by the reader
+	typingCount       int
+	typingWindowStart time.Time
+
 	// Request logger
 	logger *logrus.Entry
 }
@@ -59,8 +109,13 @@ func (c *Client) readPump() {
 
 	// Close connection and remove from hub
 	defer func() {
+		close(c.done)
+		if authenticated {
+			c.hub.mapping.Delete(user.Username, c.id)
+			c.hub.stopConnectionTyping(c.id)
+			c.hub.disconnect(user, c)
+		}
 		c.hub.unregister <- c
-		c.hub.mapping.Delete(user.Username, c.conn.RemoteAddr().String())
 		if err := c.conn.Close(); err != nil {
 			c.logger.WithError(err).Error("Failed to close websocket connection")
 		}
@@ -75,6 +130,11 @@ func (c *Client) readPump() {
 		if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
 			c.logger.WithError(err).Error("Failed to set read deadline on pong handler")
 		}
+
+		// Keep the user online
+		if authenticated {
+			c.hub.heartbeat(user.ID, c)
+		}
 		return nil
 	})
 
@@ -94,15 +154,15 @@ func (c *Client) readPump() {
 		// Parse raw message
 		var typeMessage BaseMessage
 		if err := json.Unmarshal(rawMsg, &typeMessage); err != nil {
-			c.send <- []byte(`{"status": "error", "reason": "unable to decode JSON: ` + err.Error() + `"}`)
+			c.fail("", "unable to decode JSON: "+err.Error())
 			c.logger.WithError(err).Error("Unable to parse json")
 			continue
 		}
 		c.logger.WithField("type", typeMessage.Type).Trace("New message")
 
 		// Ensure authenticated and not authenticating
-		if !authenticated && typeMessage.Type != 0 {
-			c.send <- []byte(`{"status": "error", "reason": "unauthenticated connection"}`)
+		if !authenticated && typeMessage.Type != MessageAuthentication && typeMessage.Type != MessageResume {
+			c.fail(typeMessage.Id, "unauthenticated connection")
 			c.logger.Trace("Unauthenticated connection")
 			continue
 		}
@@ -110,27 +170,38 @@ func (c *Client) readPump() {
 		// Operate on different data based on message type
 		switch typeMessage.Type {
 		// Handle authentication through websocket
-		case MessageAuthentication:
+		case MessageAuthentication, MessageResume:
 			if authenticated {
 				c.logger.Trace("User attempted to re-authenticated")
-				c.send <- []byte(`{"status": "error", "reason": "already authenticated"}`)
+				c.fail(typeMessage.Id, "already authenticated")
 				continue
 			}
 
 			c.logger.Trace("New authentication message")
 			var message AuthenticationMessage
 			if err := json.Unmarshal(rawMsg, &message); err != nil {
-				c.send <- []byte(`{"status": "error", "reason": "fatal error, please check logs"}`)
+				c.fail(typeMessage.Id, "fatal error, please check logs")
 				time.Sleep(2 * time.Second) // Wait a bit for failure message to send before dying
 				c.logger.WithError(err).Fatal("Failed to parse json for authentication message. THIS SHOULD NEVER HAPPEN")
 				return
 			}
 
+			// Set the initial subscriptions so missed events are filtered when resuming
+			if event, ok := validEvents(message.Events); !ok {
+				c.logger.WithField("event", event).Trace("Invalid event to subscribe to")
+				c.fail(typeMessage.Id, "cannot subscribe to unknown event: "+event)
+				continue
+			} else if !c.subscriptions.set(message.Chats, message.Events) {
+				c.logger.Trace("Too many subscriptions")
+				c.fail(typeMessage.Id, "too many subscriptions")
+				continue
+			}
+
 			// Validate JWT
-			token, err := util.JWT.Validate(message.Token, database.TokenAuthentication, c.db)
+			token, err := util.JWT.Validate(message.Token, database.TokenAuthentication, c.db, "messages:read")
 			if err != nil {
 				c.logger.WithError(err).Trace("Failed to validate authentication token")
-				c.send <- []byte(`{"status": "error", "reason": "invalid token:` + err.Error() + `"}`)
+				c.fail(typeMessage.Id, "invalid token: "+err.Error())
 				continue
 			}
 			c.logger.Trace("Validated authentication token")
@@ -139,7 +210,7 @@ func (c *Client) readPump() {
 			uid, err := util.JWT.UserId(token)
 			if err != nil {
 				c.logger.WithError(err).Trace("Failed to get user id from token")
-				c.send <- []byte(`{"status": "error", "reason": "` + err.Error() + `"}`)
+				c.fail(typeMessage.Id, err.Error())
 				continue
 			}
 			c.logger.WithField("uid", uid).Trace("Got user id from token")
@@ -147,12 +218,17 @@ func (c *Client) readPump() {
 			// Set uid in logger
 			c.logger = c.logger.WithField("uid", uid)
 
+			// Get stored token and the session it belongs to
+			c.db.Where("id = ?", util.JWT.TokenId(token)).First(&c.token)
+			c.session = c.token.Family
+			c.logger.WithField("session", c.session).Trace("Got session from token")
+
 			// Retrieve user info from database
 			c.db.Where("id = ?", uid).First(&user)
 			if user.ID == 0 {
 				c.logger.Trace("Specified user in token does not exist")
 				user = database.User{}
-				c.send <- []byte(`{"status": "error", "reason": "user in token does not exist"}`)
+				c.fail(typeMessage.Id, "user in token does not exist")
 				continue
 			}
 			c.logger.Trace("Retrieved user information from database")
@@ -161,22 +237,28 @@ func (c *Client) readPump() {
 			authenticated = true
 			c.logger.Trace("Set connection as authenticated")
 
-			// Register with hub
-			c.hub.mapping.Add(user.Username, c)
-
-			c.send <- []byte(`{"status": "success"}`)
+			// Register with hub, replaying missed events first if resuming
+			c.hub.subscribe(user, c, message, typeMessage.Id)
+			c.hub.connect(user, c)
 			c.logger.Debug("Authenticated websocket client")
 
-		case MessageReceive:
-			c.send <- []byte(`{"status": "error", "reason": "client cannot send message type"}`)
+		case MessageReceive, MessageEvent:
+			c.fail(typeMessage.Id, "client cannot send message type")
 			c.logger.WithField("type", typeMessage.Type).Trace("Client cannot send specified message type to server")
 
 		case MessageSent:
 			c.logger.WithField("type", typeMessage.Type).Trace("New message sent to chat")
 
+			// Ensure token can send messages
+			if !c.token.HasScope("messages:write") {
+				c.logger.Trace("Token missing scope to send messages")
+				c.fail(typeMessage.Id, "token missing required scope: messages:write")
+				continue
+			}
+
 			var message SentMessage
 			if err := json.Unmarshal(rawMsg, &message); err != nil {
-				c.send <- []byte(`{"status": "error", "reason": "fatal error, please check logs"}`)
+				c.fail(typeMessage.Id, "fatal error, please check logs")
 				time.Sleep(2 * time.Second)
 				c.logger.WithError(err).Fatal("Failed to parse json for sent message. THIS SHOULD NEVER HAPPEN")
 			}
@@ -186,7 +268,7 @@ func (c *Client) readPump() {
 			c.db.Preload("Users").Where("uuid = ?", message.Chat).First(&chat)
 			if chat.ID == 0 {
 				c.logger.WithField("chat", message.Chat).Trace("Specified chat does not exist")
-				c.send <- []byte(`{"status": "error", "reason": "specified chat does not exist"}`)
+				c.fail(typeMessage.Id, "specified chat does not exist")
 				continue
 			}
 			c.logger.WithField("chat", message.Chat).Trace("Retrieved chat information from database")
@@ -201,7 +283,7 @@ func (c *Client) readPump() {
 			}
 			if !valid {
 				c.logger.Trace("User associated with token not in chat")
-				c.send <- []byte(`{"status": "error", "reason": "user is not part of specified chat"}`)
+				c.fail(typeMessage.Id, "user is not part of specified chat")
 				continue
 			}
 			c.logger.Trace("Confirmed requesting user in chat")
@@ -209,23 +291,23 @@ func (c *Client) readPump() {
 			// Validate body
 			if message.ContentType == "" {
 				c.logger.WithFields(logrus.Fields{"type": message.ContentType, "chat": chat.UUID}).Trace("Field type not given")
-				c.send <- []byte(`{"status": "error", "reason": "field 'type' is required"}`)
+				c.fail(typeMessage.Id, "field 'type' is required")
 				continue
 			} else if message.ContentType != "message" && message.ContentType != "image" && message.ContentType != "file" {
 				c.logger.WithFields(logrus.Fields{"type": message.ContentType, "chat": chat.UUID}).Trace("Invalid type for 'type' field")
-				c.send <- []byte(`{"status": "error", "reason": "invalid type for 'type' field"}`)
+				c.fail(typeMessage.Id, "invalid type for 'type' field")
 				continue
 			} else if message.ContentType == "message" && message.Message == "" {
 				c.logger.WithFields(logrus.Fields{"chat": chat.UUID, "type": message.ContentType, "message": message.Message}).Trace("Message field must be present when type is 'message'")
-				c.send <- []byte(`{"status": "error", "reason": "field 'message' must be present"}`)
+				c.fail(typeMessage.Id, "field 'message' must be present")
 				continue
 			} else if message.ContentType == "image" && message.Filename != "" {
 				c.logger.WithFields(logrus.Fields{"chat": chat.UUID, "type": message.ContentType, "filename": message.Filename}).Trace("Filename field not be present when type is 'filename'")
-				c.send <- []byte(`{"status": "error", "reason": "field 'filename' should be empty or nonexistent"}`)
+				c.fail(typeMessage.Id, "field 'filename' should be empty or nonexistent")
 				continue
 			} else if message.ContentType == "file" && message.Filename == "" {
 				c.logger.WithFields(logrus.Fields{"chat": chat.UUID, "type": message.ContentType, "filename": message.Filename}).Trace("Filename filed must be present when type is 'filename'")
-				c.send <- []byte(`{"status": "error", "reason": "field 'filename' must be present"}`)
+				c.fail(typeMessage.Id, "field 'filename' must be present")
 				continue
 			}
 
@@ -233,6 +315,7 @@ func (c *Client) readPump() {
 			if message.ContentType == "message" {
 				// Save message
 				chatMessage := database.Message{
+					UUID:      uuid.NewV4().String(),
 					ChatId:    chat.ID,
 					SenderId:  user.ID,
 					Type:      0,
@@ -247,6 +330,9 @@ func (c *Client) readPump() {
 				c.db.Model(&chat).Association("Messages").Append(&chatMessage)
 				c.logger.WithField("chat", chat.UUID).Trace("Associated message with chat")
 
+				// Sending a message ends typing in the chat
+				c.hub.stopTyping(user.Username, chat.UUID)
+
 				// Push message over websockets
 				chatMessage.Sender = user
 				for _, u := range chat.Users {
@@ -256,10 +342,10 @@ func (c *Client) readPump() {
 					}
 
 					// Send message
-					c.hub.PushMessage(u.Username, chatMessage, chat.UUID)
+					c.hub.PushMessage(u, chatMessage, chat.UUID)
 				}
 
-				c.send <- []byte(`{"status": "success"}`)
+				c.success(typeMessage.Id, map[string]string{"uuid": chatMessage.UUID})
 				c.logger.WithFields(logrus.Fields{"message": chatMessage.ID, "sender": user.ID, "chat": chat.UUID}).Debug("Sent given message to chat")
 				continue
 			}
@@ -285,6 +371,7 @@ func (c *Client) readPump() {
 
 			// Create message database entry
 			chatMessage := database.Message{
+				UUID:      uuid.NewV4().String(),
 				ChatId:    chat.ID,
 				SenderId:  user.ID,
 				Type:      1,
@@ -308,16 +395,189 @@ func (c *Client) readPump() {
 			c.db.Model(&chat).Association("Messages").Append(&chatMessage)
 			c.logger.WithField("chat", chat.UUID).Trace("Associated message with chat")
 
-			c.send <- []byte(`{"status": "success", "data": {"url": "` + viper.GetString("http.domain") + "/api/files" + file.UUID + `"}}`)
+			c.success(typeMessage.Id, map[string]string{"uuid": chatMessage.UUID, "url": viper.GetString("http.domain") + "/api/files" + file.UUID})
 			c.logger.WithFields(logrus.Fields{"message": chatMessage.ID, "sender": chatMessage.SenderId, "file": file.UUID, "chat": chat.UUID}).Debug("Created message with file upload link attached")
 
+		case MessageMarkRead:
+			var message MarkReadMessage
+			if err := json.Unmarshal(rawMsg, &message); err != nil {
+				c.fail(typeMessage.Id, "fatal error, please check logs")
+				time.Sleep(2 * time.Second)
+				c.logger.WithError(err).Fatal("Failed to parse json for mark read message. THIS SHOULD NEVER HAPPEN")
+			}
+
+			// Ensure chat exists
+			var chat database.Chat
+			c.db.Preload("Users").Where("uuid = ?", message.Chat).First(&chat)
+			if chat.ID == 0 {
+				c.logger.WithField("chat", message.Chat).Trace("Specified chat does not exist")
+				c.fail(typeMessage.Id, "specified chat does not exist")
+				continue
+			}
+
+			// Ensure user is in chat
+			valid := false
+			for _, u := range chat.Users {
+				if user.ID == u.ID {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				c.logger.Trace("User associated with token not in chat")
+				c.fail(typeMessage.Id, "user is not part of specified chat")
+				continue
+			}
+
+			// Ensure message exists in chat
+			var chatMessage database.Message
+			c.db.Where("chat_id = ? AND uuid = ?", chat.ID, message.Message).First(&chatMessage)
+			if chatMessage.ID == 0 {
+				c.logger.WithField("message", message.Message).Trace("Specified message does not exist in chat")
+				c.fail(typeMessage.Id, "specified message does not exist")
+				continue
+			}
+
+			c.hub.MarkRead(user, chat, chatMessage)
+			c.success(typeMessage.Id, nil)
+			c.logger.WithFields(logrus.Fields{"chat": chat.UUID, "message": chatMessage.UUID}).Debug("Marked chat as read")
+
+		case MessageTypingStart, MessageTypingStop:
+			// Prevent flooding the hub
+			if !c.allowTyping() {
+				c.logger.Trace("Client exceeded typing message limit")
+				c.fail(typeMessage.Id, "too many typing messages")
+				continue
+			}
+
+			var message TypingMessage
+			if err := json.Unmarshal(rawMsg, &message); err != nil {
+				c.fail(typeMessage.Id, "fatal error, please check logs")
+				time.Sleep(2 * time.Second)
+				c.logger.WithError(err).Fatal("Failed to parse json for typing message. THIS SHOULD NEVER HAPPEN")
+			}
+
+			// Stopping only affects the user's own typing state
+			if typeMessage.Type == MessageTypingStop {
+				c.hub.stopTyping(user.Username, message.Chat)
+				c.logger.WithField("chat", message.Chat).Trace("Stopped typing in chat")
+				continue
+			}
+
+			// Keep typing without checking the chat again if already typing
+			if c.hub.extendTyping(user.Username, message.Chat) {
+				c.logger.WithField("chat", message.Chat).Trace("Extended typing in chat")
+				continue
+			}
+
+			// Ensure chat exists
+			var chat database.Chat
+			c.db.Preload("Users").Where("uuid = ?", message.Chat).First(&chat)
+			if chat.ID == 0 {
+				c.logger.WithField("chat", message.Chat).Trace("Specified chat does not exist")
+				c.fail(typeMessage.Id, "specified chat does not exist")
+				continue
+			}
+
+			// Ensure user is in chat
+			valid := false
+			for _, u := range chat.Users {
+				if user.ID == u.ID {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				c.logger.Trace("User associated with token not in chat")
+				c.fail(typeMessage.Id, "user is not part of specified chat")
+				continue
+			}
+
+			c.hub.startTyping(user.Username, chat.UUID, chat.Users, c.id)
+			c.logger.WithField("chat", chat.UUID).Debug("Started typing in chat")
+
+		case MessageSubscribe, MessageUnsubscribe:
+			var message SubscriptionMessage
+			if err := json.Unmarshal(rawMsg, &message); err != nil {
+				c.fail(typeMessage.Id, "fatal error, please check logs")
+				time.Sleep(2 * time.Second)
+				c.logger.WithError(err).Fatal("Failed to parse json for subscription message. THIS SHOULD NEVER HAPPEN")
+			}
+
+			// Change subscriptions
+			if typeMessage.Type == MessageUnsubscribe {
+				c.subscriptions.remove(message.Chats, message.Events)
+				c.logger.WithFields(logrus.Fields{"chats": len(message.Chats), "events": len(message.Events)}).Trace("Unsubscribed from chats and events")
+			} else if event, ok := validEvents(message.Events); !ok {
+				c.logger.WithField("event", event).Trace("Invalid event to subscribe to")
+				c.fail(typeMessage.Id, "cannot subscribe to unknown event: "+event)
+				continue
+			} else if !c.subscriptions.add(message.Chats, message.Events) {
+				c.logger.Trace("Too many subscriptions")
+				c.fail(typeMessage.Id, "too many subscriptions")
+				continue
+			} else {
+				c.logger.WithFields(logrus.Fields{"chats": len(message.Chats), "events": len(message.Events)}).Trace("Subscribed to chats and events")
+			}
+
+			c.success(typeMessage.Id, c.subscriptions.list())
+			c.logger.Debug("Changed subscriptions")
+
+		case MessageAck:
+			var message AckMessage
+			if err := json.Unmarshal(rawMsg, &message); err != nil {
+				c.fail(typeMessage.Id, "fatal error, please check logs")
+				time.Sleep(2 * time.Second)
+				c.logger.WithError(err).Fatal("Failed to parse json for ack message. THIS SHOULD NEVER HAPPEN")
+			}
+
+			// Acknowledgements are not responded to
+			c.hub.ack(c, message.Seq)
+			c.logger.WithField("seq", message.Seq).Trace("Client acknowledged events")
+
 		default:
-			c.send <- []byte(`{"status": "error", "reason": "invalid message type"}`)
+			c.fail(typeMessage.Id, "invalid message type")
 			c.logger.WithField("type", typeMessage.Type).Info("Invalid message type")
 		}
 	}
 }
 
+// Respond to a client message successfully, with optional data
+func (c *Client) success(id string, data interface{}) {
+	c.respond(ResponseMessage{Id: id, Status: "success", Data: data})
+}
+
+// Respond to a client message with the reason it failed
+func (c *Client) fail(id string, reason string) {
+	c.respond(ResponseMessage{Id: id, Status: "error", Reason: reason})
+}
+
+func (c *Client) respond(response ResponseMessage) {
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		c.logger.WithError(err).Error("Failed to encode to JSON")
+		return
+	}
+	c.send <- encoded
+}
+
+// Queue a message for the client without waiting, closing the connection if its queue is full
+// so the client reconnects and resumes from the event log instead of stalling others
+func (c *Client) deliver(message []byte) bool {
+	select {
+	case c.send <- message:
+		return true
+	case <-c.done:
+		return false
+	default:
+		c.logger.Warn("Client not keeping up with events, closing connection")
+		if err := c.conn.Close(); err != nil {
+			c.logger.WithError(err).Error("Failed to close websocket connection")
+		}
+		return false
+	}
+}
+
 // writePump pumps messages from the hub to the websocket connection
 //
 // A goroutine running writePump is started for each connection. The
@@ -337,6 +597,11 @@ func (c *Client) writePump() {
 
 	for {
 		select {
+		// Stop once the connection is closed
+		case <-c.done:
+			c.logger.Trace("Connection closed, stopping writer")
+			return
+
 		// Get message to be sent
 		case message, ok := <-c.send:
 			// Deadlines for messages to be written
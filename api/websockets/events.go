@@ -0,0 +1,461 @@
+package websockets
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// How long events are kept for clients to catch up on after reconnecting
+const eventRetention = 7 * 24 * time.Hour
+
+// Most events replayed to a resuming client before it is told to refetch instead
+const maxReplay = 1000
+
+// How long a client that acknowledges events has to acknowledge one before it is sent again
+const ackTimeout = 30 * time.Second
+
+// How often events older than the retention period are removed from the event log
+const pruneInterval = time.Hour
+
+// Kinds of payloads sent through the broker
+const (
+	brokerEvent        = "event"
+	brokerCloseUser    = "close_user"
+	brokerCloseSession = "close_session"
+	brokerEphemeral    = "ephemeral"
+)
+
+// Payload sent through the broker, referring to the event log instead of containing
+// the event so it stays within the size limits of brokers like Postgres
+type brokerMessage struct {
+	Action  string `json:"action"`
+	User    string `json:"user"`
+	UserId  uint   `json:"user_id,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Session string `json:"session,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+
+	// Events not recorded in the event log are sent in full to each of the users
+	Users []string        `json:"users,omitempty"`
+	Event string          `json:"event,omitempty"`
+	Chat  string          `json:"chat,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Send a payload to every instance through the broker
+func (h *Hub) publish(message brokerMessage, logger *logrus.Entry) {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode to JSON")
+		return
+	}
+
+	if err := h.broker.Publish(encoded); err != nil {
+		logger.WithError(err).Error("Failed to publish to broker")
+		return
+	}
+	logger.WithField("action", message.Action).Trace("Published to broker")
+}
+
+// Act on a payload received from the broker
+func (h *Hub) dispatch(payload []byte) {
+	var message brokerMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		logrus.WithFields(logrus.Fields{"app": "websocket", "payload": string(payload)}).WithError(err).Error("Unable to parse broker payload")
+		return
+	}
+
+	switch message.Action {
+	case brokerEvent:
+		h.deliverEvents(message.User, message.UserId, message.Seq)
+	case brokerCloseUser:
+		h.closeUser(message.User, message.Reason)
+	case brokerCloseSession:
+		h.closeSession(message.User, message.Session)
+	case brokerEphemeral:
+		h.deliverEphemeral(message.Users, message.Event, message.Chat, message.Data)
+	}
+}
+
+// Send a new message over websocket connection client
+func (h *Hub) PushMessage(receiver database.User, message database.Message, chat string) {
+	h.PushEvent(receiver, EventMessageCreated, chat, message)
+}
+
+// Send an event to every member of a chat
+func (h *Hub) PushChatEvent(members []database.User, event string, chat string, data interface{}) {
+	for _, member := range members {
+		h.PushEvent(member, event, chat, data)
+	}
+}
+
+// Record an event in the user's event log and send it over websocket connection client
+func (h *Hub) PushEvent(receiver database.User, event string, chat string, data interface{}) {
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "chat": chat, "user": receiver.Username, "event": event})
+
+	// Encode event data to JSON
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode to JSON")
+		return
+	}
+
+	// Take the next number in the user's sequence and record the event together, the sequence
+	// row stays locked until commit so events are always committed in sequence order
+	tx := h.db.Begin()
+	var seq uint64
+	if err := tx.Raw("INSERT INTO event_sequences (user_id, seq) VALUES (?, 1) ON CONFLICT (user_id) DO UPDATE SET seq = event_sequences.seq + 1 RETURNING seq", receiver.ID).Row().Scan(&seq); err != nil {
+		tx.Rollback()
+		logger.WithError(err).Error("Failed to get next event sequence number")
+		return
+	}
+	logger = logger.WithField("seq", seq)
+
+	record := database.Event{
+		UserId: receiver.ID,
+		Seq:    seq,
+		Event:  event,
+		Chat:   chat,
+		Data:   string(encoded),
+	}
+	tx.NewRecord(record)
+	if err := tx.Create(&record).Commit().Error; err != nil {
+		tx.Rollback()
+		logger.WithError(err).Error("Failed to record event in event log")
+		return
+	}
+	logger.Trace("Recorded event in event log")
+
+	// Notify every instance with connections for the user
+	h.publish(brokerMessage{Action: brokerEvent, User: receiver.Username, UserId: receiver.ID, Seq: seq}, logger)
+}
+
+// Send every recorded event up to the given sequence number to a user's clients on this instance
+//
+// Events are loaded from the event log from the last one each client received, which fills any
+// gaps left by lost or reordered broker payloads. Only each client's own lock is held while its
+// events are queued, and never while waiting on the database or a slow connection.
+func (h *Hub) deliverEvents(user string, userId uint, seq uint64) {
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "user": user, "seq": seq})
+
+	// Stop if no connections
+	clients := h.mapping.Get(user)
+	if len(clients) == 0 {
+		logger.Trace("No clients associated with user")
+		return
+	}
+
+	// Find the earliest event not yet received by a client
+	from := seq
+	for _, client := range clients {
+		client.events.Lock()
+		if client.lastSeq < from {
+			from = client.lastSeq
+		}
+		client.events.Unlock()
+	}
+	if from >= seq {
+		logger.Trace("Clients already received event")
+		return
+	}
+
+	// Get events from the event log
+	var events []database.Event
+	h.db.Where("user_id = ? AND seq > ? AND seq <= ?", userId, from, seq).Order("seq").Limit(maxReplay).Find(&events)
+	logger.WithField("events", len(events)).Trace("Retrieved events to deliver")
+
+	// Encode once for every client, both in the envelope and as receive messages for new messages
+	envelopes := make([][]byte, len(events))
+	receives := make([][]byte, len(events))
+	for i, event := range events {
+		envelope, err := encodeEvent(event, true)
+		if err != nil {
+			logger.WithError(err).Error("Failed to encode to JSON")
+			continue
+		}
+		receive, err := encodeEvent(event, false)
+		if err != nil {
+			logger.WithError(err).Error("Failed to encode to JSON")
+			continue
+		}
+		envelopes[i], receives[i] = envelope, receive
+	}
+
+	// Send to each client in order, skipping events another delivery already sent it
+	for _, client := range clients {
+		client.events.Lock()
+		messages := receives
+		if client.envelope {
+			messages = envelopes
+		}
+
+		for i, event := range events {
+			if event.Seq <= client.lastSeq || messages[i] == nil {
+				continue
+			}
+
+			// Skip events the client is not subscribed to
+			if !client.subscriptions.wants(event.Event, event.Chat) {
+				client.skipped(event.Seq)
+				continue
+			}
+
+			if !client.deliver(messages[i]) {
+				break
+			}
+			client.sent(event.Seq)
+			logger.Trace("Sent event to client")
+		}
+		client.events.Unlock()
+	}
+}
+
+// Register a client to receive a user's events, replaying every event after the given sequence number when resuming
+//
+// Holding the client's event lock means no event can be delivered to it between the replay and live delivery
+// starting, and events already replayed are skipped when their broker payload arrives, so the client receives
+// every event in order, and exactly once unless it acknowledges events and is too slow to do so
+func (h *Hub) subscribe(user database.User, client *Client, message AuthenticationMessage, requestId string) {
+	resume, after := message.Type == MessageResume, message.Seq
+	logger := client.logger.WithFields(logrus.Fields{"resume": resume, "after": after, "acks": message.Acks})
+
+	client.events.Lock()
+	defer client.events.Unlock()
+
+	// Start receiving live events once the lock is released
+	h.mapping.Add(user.Username, client)
+
+	// Get the most recent sequence number
+	var sequence database.EventSequence
+	h.db.Where("user_id = ?", user.ID).First(&sequence)
+
+	// Get missed events
+	var events []database.Event
+	complete := true
+	if resume && after < sequence.Seq {
+		h.db.Where("user_id = ? AND seq > ?", user.ID, after).Order("seq").Limit(maxReplay).Find(&events)
+
+		// Events that were pruned, or too many to replay, must be refetched from the API
+		complete = len(events) > 0 && events[0].Seq == after+1 && events[len(events)-1].Seq == sequence.Seq
+		if !complete {
+			events = nil
+		}
+	}
+
+	// Only replay events the client is subscribed to
+	var replay []database.Event
+	for _, event := range events {
+		if client.subscriptions.wants(event.Event, event.Chat) {
+			replay = append(replay, event)
+		}
+	}
+	logger.WithFields(logrus.Fields{"seq": sequence.Seq, "events": len(events), "replay": len(replay), "complete": complete}).Trace("Retrieved missed events")
+
+	// Replayed events are unacknowledged until the client acknowledges them
+	client.userId = user.ID
+	client.lastSeq = sequence.Seq
+	client.lastDelivered = sequence.Seq
+	client.acks = message.Acks
+	client.envelope = message.Envelope
+	client.ackedSeq = sequence.Seq
+	if len(replay) > 0 {
+		client.ackedSeq = after
+		client.lastDelivered = replay[len(replay)-1].Seq
+		client.unackedSince = time.Now()
+	}
+	if client.acks {
+		go h.redeliver(client)
+	}
+
+	// Respond before sending the missed events, live events continue from the latest one
+	response, err := json.Marshal(ResponseMessage{
+		Id:     requestId,
+		Status: "success",
+		Data:   map[string]interface{}{"seq": sequence.Seq, "complete": complete},
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode to JSON")
+		return
+	}
+	if !client.deliver(response) {
+		return
+	}
+	for _, event := range replay {
+		message, err := encodeEvent(event, client.envelope)
+		if err != nil {
+			logger.WithError(err).Error("Failed to encode to JSON")
+			continue
+		}
+		if !client.deliver(message) {
+			return
+		}
+	}
+	logger.Trace("Replayed missed events to client")
+}
+
+// Record that an event was sent to a client, starting the acknowledgement timeout if
+// every earlier event was acknowledged
+//
+// Must be called while holding the client's event lock
+func (c *Client) sent(seq uint64) {
+	c.lastSeq = seq
+	c.lastDelivered = seq
+	if c.acks && c.unackedSince.IsZero() {
+		c.unackedSince = time.Now()
+	}
+}
+
+// Record that an event was not sent to a client as it is not subscribed to it, which
+// counts as acknowledged once every event sent before it is acknowledged
+//
+// Must be called while holding the client's event lock
+func (c *Client) skipped(seq uint64) {
+	if c.ackedSeq == c.lastSeq {
+		c.ackedSeq = seq
+	}
+	c.lastSeq = seq
+}
+
+// Record that a client acknowledged every event up to a sequence number
+func (h *Hub) ack(client *Client, seq uint64) {
+	client.events.Lock()
+	defer client.events.Unlock()
+
+	// Ignore acknowledgements for events that were already acknowledged or never sent
+	if seq <= client.ackedSeq || seq > client.lastSeq {
+		return
+	}
+
+	// Acknowledging the last event sent also covers any skipped after it
+	client.ackedSeq = seq
+	if seq >= client.lastDelivered {
+		client.ackedSeq = client.lastSeq
+	}
+
+	// Restart the timeout for any events still unacknowledged
+	client.unackedSince = time.Time{}
+	if client.ackedSeq < client.lastSeq {
+		client.unackedSince = time.Now()
+	}
+}
+
+// Send events again to a client that acknowledges events until its connection closes,
+// whenever it has not acknowledged them within the timeout
+func (h *Hub) redeliver(client *Client) {
+	ticker := time.NewTicker(ackTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-client.done:
+			return
+
+		case <-ticker.C:
+			h.redeliverUnacked(client)
+		}
+	}
+}
+
+// Send every unacknowledged event to a client again if the oldest was sent before the timeout
+func (h *Hub) redeliverUnacked(client *Client) {
+	client.events.Lock()
+	if client.ackedSeq >= client.lastSeq || time.Since(client.unackedSince) < ackTimeout {
+		client.events.Unlock()
+		return
+	}
+	acked, last := client.ackedSeq, client.lastSeq
+	client.events.Unlock()
+	logger := client.logger.WithFields(logrus.Fields{"acked": acked, "seq": last})
+
+	// Get unacknowledged events from the event log
+	var events []database.Event
+	h.db.Where("user_id = ? AND seq > ? AND seq <= ?", client.userId, acked, last).Order("seq").Limit(maxReplay).Find(&events)
+	logger.WithField("events", len(events)).Trace("Retrieved unacknowledged events")
+
+	// Only send events the client is still subscribed to, and consider the rest acknowledged
+	var unacked []database.Event
+	for _, event := range events {
+		if client.subscriptions.wants(event.Event, event.Chat) {
+			unacked = append(unacked, event)
+		}
+	}
+
+	client.events.Lock()
+	defer client.events.Unlock()
+
+	if len(unacked) == 0 {
+		if client.ackedSeq < last {
+			client.ackedSeq = last
+		}
+		client.unackedSince = time.Time{}
+		if client.ackedSeq < client.lastSeq {
+			client.unackedSince = time.Now()
+		}
+		logger.Trace("No unacknowledged events still subscribed to")
+		return
+	}
+
+	for _, event := range unacked {
+		// Skip events acknowledged while loading them
+		if event.Seq <= client.ackedSeq {
+			continue
+		}
+
+		message, err := encodeEvent(event, client.envelope)
+		if err != nil {
+			logger.WithError(err).Error("Failed to encode to JSON")
+			continue
+		}
+		if !client.deliver(message) {
+			return
+		}
+	}
+	client.unackedSince = time.Now()
+	logger.Debug("Sent unacknowledged events to client again")
+}
+
+// Remove events too old to be replayed from the event log of every user
+func (h *Hub) pruneEvents() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result := h.db.Unscoped().Delete(database.Event{}, "created_at < ?", time.Now().Add(-eventRetention))
+		if result.Error != nil {
+			logrus.WithField("app", "websocket").WithError(result.Error).Error("Failed to prune event log")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"app": "websocket", "events": result.RowsAffected}).Trace("Pruned event log")
+	}
+}
+
+// Wrap a recorded event in the envelope sent to clients, new messages are sent as
+// receive messages instead to clients that did not opt into the envelope
+func encodeEvent(event database.Event, envelope bool) ([]byte, error) {
+	if !envelope && event.Event == EventMessageCreated {
+		var message database.Message
+		if err := json.Unmarshal([]byte(event.Data), &message); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(ReceiveMessage{
+			Type:        MessageReceive,
+			Seq:         event.Seq,
+			UUID:        message.UUID,
+			Message:     message.Message,
+			Chat:        event.Chat,
+			Sender:      message.Sender.Username,
+			ContentType: int(message.Type),
+		})
+	}
+
+	return json.Marshal(EventMessage{
+		Type:  MessageEvent,
+		Seq:   event.Seq,
+		Event: event.Event,
+		Chat:  event.Chat,
+		Data:  json.RawMessage(event.Data),
+	})
+}
@@ -3,11 +3,16 @@ package websockets
 import (
 	"github.com/akrantz01/apcsp/api/util"
 	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"log"
 	"net/http"
+	"time"
 )
 
+// Longest device name a client can give when connecting
+const maxDeviceLength = 64
+
 func Websockets(hub *Hub, db *gorm.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Ensure proper request
@@ -24,12 +29,24 @@ func Websockets(hub *Hub, db *gorm.DB) func(w http.ResponseWriter, r *http.Reque
 		}
 
 		// Create new client with hub and websocket connection
+		id := uuid.NewV4().String()
 		client := &Client{
-			hub:    hub,
-			conn:   conn,
-			send:   make(chan []byte, 256),
-			db:     db,
-			logger: logrus.WithFields(logrus.Fields{"app": "websocket", "remote_address": r.RemoteAddr}),
+			hub:           hub,
+			id:            id,
+			conn:          conn,
+			send:          make(chan []byte, sendBuffer),
+			done:          make(chan struct{}),
+			device:        r.URL.Query().Get("device"),
+			userAgent:     r.UserAgent(),
+			remoteAddress: r.RemoteAddr,
+			forwardedFor:  r.Header.Get("X-Forwarded-For"),
+			connectedAt:   time.Now(),
+			subscriptions: newSubscriptions(),
+			db:            db,
+			logger:        logrus.WithFields(logrus.Fields{"app": "websocket", "remote_address": r.RemoteAddr, "connection": id}),
+		}
+		if len(client.device) > maxDeviceLength {
+			client.device = client.device[:maxDeviceLength]
 		}
 
 		// Register with hub
@@ -1,10 +1,13 @@
 package websockets
 
 import (
-	"encoding/json"
-	"github.com/akrantz01/apcsp/api/database"
+	"github.com/gorilla/websocket"
+	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
+	"os"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // Maintains the set of active clients and broadcasts messages to the clients
@@ -23,11 +26,32 @@ type Hub struct {
 
 	// Client to user mapping
 	mapping UserMapping
+
+	// Access to the database for the event log
+	db *gorm.DB
+
+	// Delivers events to every instance
+	broker Broker
+
+	// Users typing through connections to this instance
+	typing typingState
+
+	// Identifies this instance in the connections shared by every instance
+	instance string
 }
 
 // Hub "constructor"
-func NewHub() *Hub {
-	return &Hub{
+func NewHub(db *gorm.DB, broker Broker) *Hub {
+	// Name the instance after its host and process so replicas can be told apart
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	h := &Hub{
+		instance:   host + ":" + strconv.Itoa(os.Getpid()),
+		db:         db,
+		broker:     broker,
 		clients:    make(map[*Client]bool),
 		broadcast:  make(chan []byte),
 		register:   make(chan *Client),
@@ -36,7 +60,20 @@ func NewHub() *Hub {
 			RWMutex: sync.RWMutex{},
 			mapping: make(map[string]map[string]*Client),
 		},
+		typing: typingState{
+			entries: make(map[string]*typingEntry),
+		},
+	}
+
+	// Receive events from every instance
+	if err := broker.Subscribe(h.dispatch); err != nil {
+		logrus.WithField("app", "websocket").WithError(err).Fatal("Failed to subscribe to websocket event broker")
 	}
+
+	// Remove expired events in the background rather than while recording them
+	go h.pruneEvents()
+
+	return h
 }
 
 // Main websocket runner
@@ -48,12 +85,9 @@ func (h *Hub) Run() {
 		case client := <-h.register:
 			h.clients[client] = true
 
-		// Unregister a client & close connection
+		// Unregister a client, the connection's done channel stops its writer
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; !ok {
-				delete(h.clients, client)
-				close(client.send)
-			}
+			delete(h.clients, client)
 
 		// Send message to all clients
 		case message := <-h.broadcast:
@@ -73,39 +107,51 @@ func (h *Hub) Run() {
 	}
 }
 
-// Send message over websocket connection client
-func (h *Hub) PushMessage(receiver string, message database.Message, chat string) {
-	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "chat": chat, "user": receiver})
+// Close all of a user's connections that were authenticated from the given session on every instance
+func (h *Hub) CloseSession(receiver string, session string) {
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "user": receiver, "session": session})
+	h.publish(brokerMessage{Action: brokerCloseSession, User: receiver, Session: session}, logger)
+}
 
-	clients := h.mapping.Get(receiver)
-	logger.WithField("count", len(clients)).Trace("Got list of clients")
+// Close all of a user's connections on this instance that were authenticated from the given session
+func (h *Hub) closeSession(receiver string, session string) {
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "user": receiver, "session": session})
 
-	// Stop if no connections
-	if len(clients) == 0 {
-		logger.Trace("No clients associated with user")
-		return
-	}
+	for _, client := range h.mapping.Get(receiver) {
+		// Ignore connections from other sessions
+		if client.session != session {
+			continue
+		}
 
-	// Assemble client message
-	msg := ReceiveMessage{
-		Type:        MessageReceive,
-		Message:     message.Message,
-		Chat:        chat,
-		Sender:      message.Sender.Username,
-		ContentType: int(message.Type),
+		// Notify client and close connection
+		if err := client.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked"), time.Now().Add(writeWait)); err != nil {
+			logger.WithError(err).Trace("Failed to send close message to client")
+		}
+		if err := client.conn.Close(); err != nil {
+			logger.WithError(err).Error("Failed to close websocket connection")
+		}
+		logger.Trace("Closed connection for revoked session")
 	}
-	logger.Trace("Assembled message to send to clients")
+}
 
-	// Encode message to JSON
-	encoded, err := json.Marshal(msg)
-	if err != nil {
-		logger.WithError(err).Error("Failed to encode to JSON")
-		return
-	}
+// Close all of a user's connections on every instance
+func (h *Hub) CloseUser(receiver string, reason string) {
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "user": receiver})
+	h.publish(brokerMessage{Action: brokerCloseUser, User: receiver, Reason: reason}, logger)
+}
 
-	// Send to each client
-	for _, client := range clients {
-		client.send <- encoded
-		logger.Trace("Sent message to client")
+// Close all of a user's connections on this instance
+func (h *Hub) closeUser(receiver string, reason string) {
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "user": receiver})
+
+	for _, client := range h.mapping.Get(receiver) {
+		// Notify client and close connection
+		if err := client.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(writeWait)); err != nil {
+			logger.WithError(err).Trace("Failed to send close message to client")
+		}
+		if err := client.conn.Close(); err != nil {
+			logger.WithError(err).Error("Failed to close websocket connection")
+		}
+		logger.Trace("Closed connection for user")
 	}
 }
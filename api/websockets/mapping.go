@@ -1,8 +1,6 @@
 package websockets
 
-import (
-	"sync"
-)
+import "sync"
 
 // Create mapping of users to client connections
 type UserMapping struct {
@@ -21,7 +19,7 @@ func (um *UserMapping) Get(id string) []*Client {
 		return nil
 	}
 
-	// Convert ip-client map to array
+	// Convert id-client map to array
 	var clients []*Client
 	for _, client := range um.mapping[id] {
 		clients = append(clients, client)
@@ -31,7 +29,7 @@ func (um *UserMapping) Get(id string) []*Client {
 	return clients
 }
 
-// Map client connection to ip to client id
+// Map client connection by its connection id to user id
 func (um *UserMapping) Add(id string, client *Client) {
 	// Lock for writing
 	um.Lock()
@@ -43,10 +41,11 @@ func (um *UserMapping) Add(id string, client *Client) {
 	}
 
 	// Add client
-	um.mapping[id][client.conn.RemoteAddr().String()] = client
+	um.mapping[id][client.id] = client
 }
 
-func (um *UserMapping) Delete(id string, ip string) {
+// Remove a client connection by its connection id from a user
+func (um *UserMapping) Delete(id string, connection string) {
 	// Lock for deletion
 	um.Lock()
 	defer um.Unlock()
@@ -56,6 +55,9 @@ func (um *UserMapping) Delete(id string, ip string) {
 		return
 	}
 
-	// Delete the client
-	delete(um.mapping[id], ip)
+	// Delete the client, and the user once they have no clients left
+	delete(um.mapping[id], connection)
+	if len(um.mapping[id]) == 0 {
+		delete(um.mapping, id)
+	}
 }
@@ -1,22 +1,94 @@
 package websockets
 
+import "encoding/json"
+
 const (
 	MessageAuthentication = iota
 	MessageReceive
 	MessageSent
+	MessageEvent
+	MessageResume
+	MessageTypingStart
+	MessageTypingStop
+	MessageMarkRead
+	MessageAck
+	MessageSubscribe
+	MessageUnsubscribe
+)
+
+// Names of events pushed to clients when something changes
+const (
+	EventMessageCreated    = "message.created"
+	EventMessageUpdated    = "message.updated"
+	EventMessageDeleted    = "message.deleted"
+	EventChatCreated       = "chat.created"
+	EventChatUpdated       = "chat.updated"
+	EventChatDeleted       = "chat.deleted"
+	EventChatMemberAdded   = "chat.member_added"
+	EventChatMemberRemoved = "chat.member_removed"
+	EventChatRead          = "chat.read"
+	EventTypingStarted     = "typing.started"
+	EventTypingStopped     = "typing.stopped"
+	EventPresenceUpdated   = "presence.updated"
+)
+
+// Why a user was removed from a chat
+const (
+	RemovedLeft   = "left"
+	RemovedByUser = "removed"
 )
 
 type BaseMessage struct {
 	Type int `json:"type"`
+
+	// Chosen by the client and echoed in the response to the message
+	Id string `json:"id"`
+}
+
+// Response to a client message
+type ResponseMessage struct {
+	Id     string      `json:"id,omitempty"`
+	Status string      `json:"status"`
+	Reason string      `json:"reason,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
 }
 
 type AuthenticationMessage struct {
 	Type  int    `json:"type"`
 	Token string `json:"token"`
+
+	// Last event sequence number seen, only used when resuming
+	Seq uint64 `json:"seq"`
+
+	// Whether the client acknowledges events, so unacknowledged ones are sent again
+	Acks bool `json:"acks"`
+
+	// Whether new messages are sent as message.created events instead of receive messages
+	Envelope bool `json:"envelope"`
+
+	// Chats and events to receive instead of everything
+	Chats  []string `json:"chats"`
+	Events []string `json:"events"`
+}
+
+// Add or remove chats and events the connection receives
+type SubscriptionMessage struct {
+	Type   int      `json:"type"`
+	Chats  []string `json:"chats"`
+	Events []string `json:"events"`
+}
+
+// Acknowledge every event up to and including a sequence number
+type AckMessage struct {
+	Type int    `json:"type"`
+	Seq  uint64 `json:"seq"`
 }
 
+// New message sent to clients that did not opt into the event envelope
 type ReceiveMessage struct {
 	Type        int    `json:"type"`
+	Seq         uint64 `json:"seq"`
+	UUID        string `json:"uuid"`
 	Message     string `json:"message"`
 	Chat        string `json:"chat"`
 	Sender      string `json:"sender"`
@@ -30,3 +102,59 @@ type SentMessage struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"content-type"`
 }
+
+// Start or stop typing in a chat
+type TypingMessage struct {
+	Type int    `json:"type"`
+	Chat string `json:"chat"`
+}
+
+// Mark a chat as read up to a message
+type MarkReadMessage struct {
+	Type    int    `json:"type"`
+	Chat    string `json:"chat"`
+	Message string `json:"message"`
+}
+
+// Envelope for all events pushed to clients, events not recorded in the event log have no sequence number
+type EventMessage struct {
+	Type  int             `json:"type"`
+	Seq   uint64          `json:"seq,omitempty"`
+	Event string          `json:"event"`
+	Chat  string          `json:"chat,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// Data for the chat.member_added and chat.member_removed events
+type MemberEvent struct {
+	User   string `json:"user"`
+	Role   string `json:"role,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Data for the message.deleted and chat.deleted events
+type DeletedEvent struct {
+	UUID      string `json:"uuid"`
+	DeletedBy string `json:"deleted_by"`
+}
+
+// Data for the typing.started and typing.stopped events
+type TypingEvent struct {
+	User string `json:"user"`
+}
+
+// Data for the presence.updated event
+type PresenceEvent struct {
+	User       string `json:"user"`
+	Presence   string `json:"presence"`
+	Status     string `json:"status"`
+	StatusText string `json:"status_text"`
+	LastSeen   int64  `json:"last_seen"`
+}
+
+// Data for the chat.read event
+type ReadEvent struct {
+	User    string `json:"user"`
+	Message string `json:"message"`
+	ReadAt  int64  `json:"read_at"`
+}
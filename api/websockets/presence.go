@@ -0,0 +1,171 @@
+package websockets
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// Presence of a user without a status set
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// How long a connection counts towards presence without a heartbeat, which covers
+// connections left behind by an instance that stopped without closing them
+const presenceTimeout = 2 * pongWait
+
+// Record a new connection for a user, notifying users sharing a chat if they came online
+func (h *Hub) connect(user database.User, client *Client) {
+	now := time.Now()
+
+	// Remove connections that stopped sending heartbeats
+	h.db.Where("heartbeat_at < ?", now.Add(-presenceTimeout).UnixNano()).Delete(database.Connection{})
+
+	wasOnline := h.online(user.ID)
+	h.db.Create(&database.Connection{
+		Id:            client.id,
+		UserId:        user.ID,
+		HeartbeatAt:   now.UnixNano(),
+		Instance:      h.instance,
+		Session:       client.session,
+		Device:        client.device,
+		UserAgent:     client.userAgent,
+		RemoteAddress: client.remoteAddress,
+		ForwardedFor:  client.forwardedFor,
+		ConnectedAt:   client.connectedAt,
+	})
+	h.seen(user.ID, now)
+	client.logger.Trace("Recorded connection for presence")
+
+	if !wasOnline {
+		user.LastSeen = now.UnixNano()
+		h.PushPresence(user)
+	}
+}
+
+// Keep a connection counting towards presence
+func (h *Hub) heartbeat(userId uint, client *Client) {
+	now := time.Now()
+	h.db.Model(&database.Connection{}).Where("id = ?", client.id).UpdateColumn("heartbeat_at", now.UnixNano())
+	h.seen(userId, now)
+}
+
+// Remove a closed connection, notifying users sharing a chat if the user went offline
+func (h *Hub) disconnect(user database.User, client *Client) {
+	now := time.Now()
+	h.db.Where("id = ?", client.id).Delete(database.Connection{})
+	h.seen(user.ID, now)
+	client.logger.Trace("Removed connection for presence")
+
+	if !h.online(user.ID) {
+		user.LastSeen = now.UnixNano()
+		h.PushPresence(user)
+	}
+}
+
+// Update when a user was last seen
+func (h *Hub) seen(userId uint, at time.Time) {
+	h.db.Model(&database.User{}).Where("id = ?", userId).UpdateColumn("last_seen", at.UnixNano())
+}
+
+// Check if a user has a live connection to any instance
+func (h *Hub) online(userId uint) bool {
+	var count int
+	h.db.Model(&database.Connection{}).Where("user_id = ? AND heartbeat_at >= ?", userId, time.Now().Add(-presenceTimeout).UnixNano()).Count(&count)
+	return count != 0
+}
+
+// Details of a live client connection
+type ConnectionInfo struct {
+	Id            string    `json:"id"`
+	Instance      string    `json:"instance"`
+	Session       string    `json:"session"`
+	Device        string    `json:"device"`
+	UserAgent     string    `json:"user_agent"`
+	RemoteAddress string    `json:"remote_address"`
+	ForwardedFor  string    `json:"forwarded_for,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+}
+
+// Get the number of connected users and connections across every instance
+func (h *Hub) Connections() (int, int) {
+	var counts struct {
+		Users       int
+		Connections int
+	}
+	h.db.Model(&database.Connection{}).Select("COUNT(DISTINCT user_id) AS users, COUNT(*) AS connections").
+		Where("heartbeat_at >= ?", time.Now().Add(-presenceTimeout).UnixNano()).Scan(&counts)
+	return counts.Users, counts.Connections
+}
+
+// Describe the live connections of each user across every instance, or only the given user if not empty
+func (h *Hub) ConnectionList(username string) map[string][]ConnectionInfo {
+	var rows []struct {
+		Username string
+		database.Connection
+	}
+	query := h.db.Table("connections").Select("users.username, connections.*").
+		Joins("JOIN users ON users.id = connections.user_id").
+		Where("connections.heartbeat_at >= ?", time.Now().Add(-presenceTimeout).UnixNano())
+	if username != "" {
+		query = query.Where("users.username = ?", username)
+	}
+	query.Order("connections.connected_at").Scan(&rows)
+
+	connections := make(map[string][]ConnectionInfo)
+	for _, row := range rows {
+		connections[row.Username] = append(connections[row.Username], ConnectionInfo{
+			Id:            row.Id,
+			Instance:      row.Instance,
+			Session:       row.Session,
+			Device:        row.Device,
+			UserAgent:     row.UserAgent,
+			RemoteAddress: row.RemoteAddress,
+			ForwardedFor:  row.ForwardedFor,
+			ConnectedAt:   row.ConnectedAt,
+		})
+	}
+	return connections
+}
+
+// Get a user's presence, which is their status while they are connected
+func (h *Hub) Presence(user database.User) string {
+	if !h.online(user.ID) {
+		return PresenceOffline
+	} else if user.Status != database.StatusNone {
+		return user.Status
+	}
+	return PresenceOnline
+}
+
+// Send a user's presence to themselves and every user they share a chat with
+func (h *Hub) PushPresence(user database.User) {
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "user": user.Username, "event": EventPresenceUpdated})
+
+	// Find users sharing a chat
+	var users []string
+	h.db.Table("users").Joins("JOIN user_chats ON user_chats.user_id = users.id").
+		Where("user_chats.chat_id IN (SELECT chat_id FROM user_chats WHERE user_id = ?)", user.ID).
+		Where("users.deleted_at IS NULL").Pluck("DISTINCT users.username", &users)
+	if len(users) == 0 {
+		users = []string{user.Username}
+	}
+	logger.WithField("users", len(users)).Trace("Retrieved users sharing a chat")
+
+	encoded, err := json.Marshal(PresenceEvent{
+		User:       user.Username,
+		Presence:   h.Presence(user),
+		Status:     user.Status,
+		StatusText: user.StatusText,
+		LastSeen:   user.LastSeen,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode to JSON")
+		return
+	}
+
+	h.publish(brokerMessage{Action: brokerEphemeral, Users: users, Event: EventPresenceUpdated, Data: encoded}, logger)
+}
@@ -0,0 +1,32 @@
+package websockets
+
+import (
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// Move a user's read marker in a chat forward to a message, notifying the members of the chat
+//
+// Returns false if the user had already read up to or past the message
+func (h *Hub) MarkRead(user database.User, chat database.Chat, message database.Message) bool {
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "chat": chat.UUID, "user": user.Username, "message": message.UUID})
+
+	// Only ever move forward, so receipts arriving out of order are ignored
+	now := time.Now().UnixNano()
+	result := h.db.Model(&database.UserChat{}).Where("user_id = ? AND chat_id = ? AND last_read_id < ?", user.ID, chat.ID, message.ID).
+		UpdateColumns(map[string]interface{}{"last_read_id": message.ID, "last_read_at": now})
+	if result.RowsAffected == 0 {
+		logger.Trace("Chat already read up to message")
+		return false
+	}
+	logger.Trace("Moved read marker forward")
+
+	// Notify every member, including the user's other connections
+	h.PushChatEvent(chat.Users, EventChatRead, chat.UUID, ReadEvent{
+		User:    user.Username,
+		Message: message.UUID,
+		ReadAt:  now,
+	})
+	return true
+}
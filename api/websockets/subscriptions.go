@@ -0,0 +1,144 @@
+package websockets
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Subscribes to every chat or event
+const subscribeAll = "*"
+
+// Most chats or events a connection can subscribe to individually, a message listing this
+// many chat uuids along with a token stays well within the largest message a client can send
+const maxSubscriptions = 1000
+
+// Every event that can be subscribed to
+var subscribableEvents = []string{
+	EventMessageCreated, EventMessageUpdated, EventMessageDeleted,
+	EventChatCreated, EventChatUpdated, EventChatDeleted, EventChatMemberAdded, EventChatMemberRemoved, EventChatRead,
+	EventTypingStarted, EventTypingStopped,
+	EventPresenceUpdated,
+}
+
+// The chats and events a connection receives, which is everything until it changes them
+type subscriptions struct {
+	sync.RWMutex
+	chats  map[string]bool
+	events map[string]bool
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		chats:  map[string]bool{subscribeAll: true},
+		events: map[string]bool{subscribeAll: true},
+	}
+}
+
+// Check that each event is either every event, a known event, or every event in a
+// category such as message.*, returning the first that is not
+func validEvents(events []string) (string, bool) {
+	for _, event := range events {
+		valid := event == subscribeAll
+		for _, known := range subscribableEvents {
+			if event == known || event == eventCategory(known)+".*" {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return event, false
+		}
+	}
+	return "", true
+}
+
+// Get the part of an event name before the first dot
+func eventCategory(event string) string {
+	return strings.SplitN(event, ".", 2)[0]
+}
+
+// Replace the subscribed chats and events with the given ones, keeping the current ones if none are given
+func (s *subscriptions) set(chats []string, events []string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(chats) > maxSubscriptions || len(events) > maxSubscriptions {
+		return false
+	}
+
+	if len(chats) > 0 {
+		s.chats = make(map[string]bool)
+	}
+	if len(events) > 0 {
+		s.events = make(map[string]bool)
+	}
+	for _, chat := range chats {
+		s.chats[chat] = true
+	}
+	for _, event := range events {
+		s.events[event] = true
+	}
+	return true
+}
+
+// Add chats and events to the subscriptions, returning false if there would be too many
+func (s *subscriptions) add(chats []string, events []string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.chats)+len(chats) > maxSubscriptions || len(s.events)+len(events) > maxSubscriptions {
+		return false
+	}
+
+	for _, chat := range chats {
+		s.chats[chat] = true
+	}
+	for _, event := range events {
+		s.events[event] = true
+	}
+	return true
+}
+
+// Remove chats and events from the subscriptions
+func (s *subscriptions) remove(chats []string, events []string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, chat := range chats {
+		delete(s.chats, chat)
+	}
+	for _, event := range events {
+		delete(s.events, event)
+	}
+}
+
+// Check if an event is subscribed to, events that are not for a specific chat only need to match the event
+func (s *subscriptions) wants(event string, chat string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	chatMatches := chat == "" || s.chats[subscribeAll] || s.chats[chat]
+	eventMatches := s.events[subscribeAll] || s.events[event] || s.events[eventCategory(event)+".*"]
+	return chatMatches && eventMatches
+}
+
+// Get the subscribed chats and events in order
+func (s *subscriptions) list() map[string][]string {
+	s.RLock()
+	defer s.RUnlock()
+
+	chats := make([]string, 0, len(s.chats))
+	for chat := range s.chats {
+		chats = append(chats, chat)
+	}
+	sort.Strings(chats)
+
+	events := make([]string, 0, len(s.events))
+	for event := range s.events {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+
+	return map[string][]string{"chats": chats, "events": events}
+}
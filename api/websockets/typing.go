@@ -0,0 +1,193 @@
+package websockets
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/apcsp/api/database"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Typing indicator configuration
+const (
+	// How long a user is shown as typing without another typing start message
+	typingTimeout = 10 * time.Second
+
+	// Most typing messages a client can send within the window before they are rejected
+	typingLimit  = 10
+	typingWindow = 5 * time.Second
+)
+
+// A user typing in a chat, which is only kept in memory by the instance the user is connected to
+type typingEntry struct {
+	user string
+	chat string
+
+	// Connection that started typing, so it can be stopped when the connection closes
+	connection string
+
+	// Members of the chat that are notified, excluding the typing user
+	members []string
+
+	// Stops typing once it expires
+	timer *time.Timer
+}
+
+// Users currently typing in each chat
+type typingState struct {
+	sync.Mutex
+	entries map[string]*typingEntry
+}
+
+// Key for a user typing in a chat
+func typingKey(user string, chat string) string {
+	return user + "/" + chat
+}
+
+// Keep a user shown as typing in a chat, returning false if they are not already typing
+func (h *Hub) extendTyping(user string, chat string) bool {
+	h.typing.Lock()
+	defer h.typing.Unlock()
+
+	entry, ok := h.typing.entries[typingKey(user, chat)]
+	if !ok {
+		return false
+	}
+
+	entry.timer.Reset(typingTimeout)
+	return true
+}
+
+// Show a user as typing in a chat to the other members until they stop or it expires
+func (h *Hub) startTyping(user string, chat string, members []database.User, connection string) {
+	h.typing.Lock()
+
+	// Only extend if started since checking
+	key := typingKey(user, chat)
+	if entry, ok := h.typing.entries[key]; ok {
+		entry.timer.Reset(typingTimeout)
+		h.typing.Unlock()
+		return
+	}
+
+	// Notify everyone but the typing user
+	entry := &typingEntry{user: user, chat: chat, connection: connection}
+	for _, member := range members {
+		if member.Username != user {
+			entry.members = append(entry.members, member.Username)
+		}
+	}
+	entry.timer = time.AfterFunc(typingTimeout, func() {
+		h.endTyping(key, entry)
+	})
+	h.typing.entries[key] = entry
+
+	// Publish while locked so a stop can't be published before its start
+	h.publishTyping(EventTypingStarted, user, chat, entry.members)
+	h.typing.Unlock()
+}
+
+// Stop showing a user as typing in a chat
+func (h *Hub) stopTyping(user string, chat string) {
+	key := typingKey(user, chat)
+
+	h.typing.Lock()
+	entry, ok := h.typing.entries[key]
+	h.typing.Unlock()
+
+	if ok {
+		h.endTyping(key, entry)
+	}
+}
+
+// Stop every chat a connection is typing in, such as when it closes
+func (h *Hub) stopConnectionTyping(connection string) {
+	h.typing.Lock()
+	entries := make(map[string]*typingEntry)
+	for key, entry := range h.typing.entries {
+		if entry.connection == connection {
+			entries[key] = entry
+		}
+	}
+	h.typing.Unlock()
+
+	for key, entry := range entries {
+		h.endTyping(key, entry)
+	}
+}
+
+// Remove a typing entry and notify the members, unless it was already replaced or removed
+func (h *Hub) endTyping(key string, entry *typingEntry) {
+	h.typing.Lock()
+	if h.typing.entries[key] != entry {
+		h.typing.Unlock()
+		return
+	}
+	entry.timer.Stop()
+	delete(h.typing.entries, key)
+
+	h.publishTyping(EventTypingStopped, entry.user, entry.chat, entry.members)
+	h.typing.Unlock()
+}
+
+// Send a typing event to the members' connections on every instance
+func (h *Hub) publishTyping(event string, user string, chat string, members []string) {
+	if len(members) == 0 {
+		return
+	}
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "chat": chat, "user": user, "event": event})
+
+	encoded, err := json.Marshal(TypingEvent{User: user})
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode to JSON")
+		return
+	}
+
+	h.publish(brokerMessage{Action: brokerEphemeral, Users: members, Event: event, Chat: chat, Data: encoded}, logger)
+}
+
+// Send an event that is not recorded in the event log to a users' clients on this instance
+//
+// Clients that are not keeping up are skipped rather than waited for, as the event
+// is only useful while it is current
+func (h *Hub) deliverEphemeral(users []string, event string, chat string, data json.RawMessage) {
+	logger := logrus.WithFields(logrus.Fields{"app": "websocket", "chat": chat, "event": event})
+
+	message, err := json.Marshal(EventMessage{
+		Type:  MessageEvent,
+		Event: event,
+		Chat:  chat,
+		Data:  data,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode to JSON")
+		return
+	}
+
+	for _, user := range users {
+		for _, client := range h.mapping.Get(user) {
+			if !client.subscriptions.wants(event, chat) {
+				continue
+			}
+
+			select {
+			case client.send <- message:
+			case <-client.done:
+			default:
+				logger.WithField("user", user).Trace("Client not keeping up, skipped event")
+			}
+		}
+	}
+}
+
+// Count a typing message against the client's limit, returning false if it is over the limit
+func (c *Client) allowTyping() bool {
+	now := time.Now()
+	if now.Sub(c.typingWindowStart) > typingWindow {
+		c.typingWindowStart = now
+		c.typingCount = 0
+	}
+
+	c.typingCount++
+	return c.typingCount <= typingLimit
+}